@@ -0,0 +1,62 @@
+package graphite
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// Aggregator is a user-defined aggregation of the values of a metric registered with RegisterCustom,
+// for example a trimmed mean or a median of the last N values.
+// The methods of an Aggregator are called from a single goroutine, so it doesn't need to be safe for concurrent use.
+type Aggregator interface {
+	// Observe processes a new value.
+	Observe(value float64)
+	// Snapshot returns the series of the interval by suffix: the suffix "" is sent as the metric name itself
+	// and any other suffix as name.<suffix>. Dots separate the nodes of a suffix, and each node is sanitized with SanitizeKey.
+	// Of the suffixes sanitized to the same series only the first in sorted order is sent, and the others are logged.
+	Snapshot() map[string]float64
+	// Reset clears the state at the start of a new interval.
+	Reset()
+}
+
+// Merger is an optional interface of an Aggregator that can add the state of another Aggregator created by the same factory.
+// A metric with several resolutions (see MetricResolutions) and a Merger observes each value once and merges the values
+// into each resolution at the flushes, instead of observing each value once per resolution, as the stats, quantile and set metrics do.
+type Merger interface {
+	Merge(other Aggregator) error
+}
+
+// writeSnapshot sends the series of a custom metric ordered by suffix.
+// If several suffixes are sanitized to the same series, only the first of them in this order is sent.
+func (gr *Graphite) writeSnapshot(name string, value *graphiteMetric, current_time string) {
+	snapshot := value.aggregator.Snapshot()
+	suffixes := make([]string, 0, len(snapshot))
+	for suffix := range snapshot {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+
+	series := make(map[string]bool, len(suffixes))
+	for _, suffix := range suffixes {
+		seriesName := name
+		if suffix != "" {
+			seriesName = name + "." + sanitizeSuffix(suffix)
+		}
+		if series[seriesName] == true {
+			log.Printf("Graphite.writeSnapshot: Suffix %q of metric %s duplicates series %s. Dropped.", suffix, name, seriesName)
+			continue
+		}
+		series[seriesName] = true
+		gr.writeLine(seriesName, formatValue(snapshot[suffix]), current_time)
+	}
+}
+
+// sanitizeSuffix sanitizes each dot-separated node of the suffix, so that a suffix can't break the plaintext protocol.
+func sanitizeSuffix(suffix string) string {
+	nodes := strings.Split(suffix, ".")
+	for i, node := range nodes {
+		nodes[i] = SanitizeKey(node)
+	}
+	return strings.Join(nodes, ".")
+}
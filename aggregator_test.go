@@ -0,0 +1,195 @@
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spreadAggregator sends the difference between the maximum and the minimum and the number of values.
+type spreadAggregator struct {
+	min, max float64
+	count    int
+}
+
+func (a *spreadAggregator) Observe(value float64) {
+	if a.count == 0 || value < a.min {
+		a.min = value
+	}
+	if a.count == 0 || value > a.max {
+		a.max = value
+	}
+	a.count += 1
+}
+
+func (a *spreadAggregator) Snapshot() map[string]float64 {
+	return map[string]float64{"": a.max - a.min, "count": float64(a.count)}
+}
+
+func (a *spreadAggregator) Reset() {
+	*a = spreadAggregator{}
+}
+
+// mergingSpreadAggregator is a spreadAggregator, which is a Merger too.
+type mergingSpreadAggregator struct {
+	spreadAggregator
+}
+
+func (a *mergingSpreadAggregator) Merge(other Aggregator) error {
+	o, ok := other.(*mergingSpreadAggregator)
+	if !ok {
+		return fmt.Errorf("Unexpected aggregator %T", other)
+	}
+	if o.count > 0 {
+		a.Observe(o.min)
+		a.Observe(o.max)
+		a.count += o.count - 2
+	}
+	return nil
+}
+
+func (a *mergingSpreadAggregator) Reset() {
+	*a = mergingSpreadAggregator{}
+}
+
+func TestRegisterCustom(t *testing.T) {
+	graph, _ := NewGraphite("localhost", 0, "prefix", 2*time.Second, false)
+
+	err := graph.RegisterCustom("spread", func() Aggregator { return new(spreadAggregator) })
+	if err != nil {
+		t.Errorf("graph.RegisterCustom() got error(%v)", err)
+	}
+
+	metric := graph.metrics["spread"]
+	if metric.mType != metricCustom || metric.aggregator == nil || metric.staged == true {
+		t.Error("Expected metricCustom with aggregator, got ", metric.mType)
+	}
+
+	if err = graph.RegisterCustom("c1", nil); err == nil {
+		t.Error("Expected error for nil factory")
+	}
+
+	if err = graph.RegisterCustom("c2", func() Aggregator { return nil }); err == nil {
+		t.Error("Expected error for nil aggregator")
+	}
+}
+
+func TestFillBufferCustom(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterCustom("spread", func() Aggregator { return new(spreadAggregator) })
+	graph.RegisterCustom("idle", func() Aggregator { return new(spreadAggregator) }, MetricIdleZeros(true))
+	graph.RegisterCustom("skipped", func() Aggregator { return new(spreadAggregator) })
+	for _, v := range []float64{5, 1, 8, 3} {
+		graph.metrics["spread"].handleValue(v)
+	}
+
+	tm := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	graph.fillBuffer(tm)
+
+	expected := []string{
+		"prefix.idle 0.000000000000 946782245",
+		"prefix.idle.count 0.000000000000 946782245",
+		"prefix.spread 7.000000000000 946782245",
+		"prefix.spread.count 4.000000000000 946782245",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+
+	// The aggregator is reset after the flush
+	graph.buffer.Reset()
+	graph.metrics["spread"].handleValue(2)
+	graph.fillBuffer(tm)
+	if output := graph.buffer.String(); !strings.Contains(output, "prefix.spread 0.000000000000 946782245\n") {
+		t.Errorf("Expected reset aggregator, got \"%v\"", output)
+	}
+}
+
+func TestCustomResolutions(t *testing.T) {
+	factories := map[string]func() Aggregator{
+		"plain":   func() Aggregator { return new(spreadAggregator) },
+		"merging": func() Aggregator { return new(mergingSpreadAggregator) },
+	}
+
+	for name, factory := range factories {
+		graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false)
+		graph.RegisterCustom("spread", factory, MetricResolutions(10*time.Second, 30*time.Second))
+		if staged := graph.metrics["spread"].staged; staged != (name == "merging") {
+			t.Errorf("%v: Expected staged %v, got %v", name, name == "merging", staged)
+		}
+		tm := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		for i, values := range [][]float64{{5, 1}, {8}, {3, 4}} {
+			for _, v := range values {
+				graph.handleValue(graphiteValue{name: "spread", value: v})
+			}
+			graph.fillBuffer(tm.Add(time.Duration(i) * 10 * time.Second))
+		}
+
+		// Both resolutions get all values once, whether they are observed by each resolution or merged
+		expected := "prefix.spread.10s 4.000000000000 946782245\n" +
+			"prefix.spread.10s.count 2.000000000000 946782245\n" +
+			"prefix.spread.10s 0.000000000000 946782255\n" +
+			"prefix.spread.10s.count 1.000000000000 946782255\n" +
+			"prefix.spread.10s 1.000000000000 946782265\n" +
+			"prefix.spread.10s.count 2.000000000000 946782265\n" +
+			"prefix.spread.30s 7.000000000000 946782265\n" +
+			"prefix.spread.30s.count 5.000000000000 946782265\n"
+		if output := graph.buffer.String(); output != expected {
+			t.Errorf("%v: Expected \"%v\", got \"%v\"", name, expected, output)
+		}
+	}
+}
+
+// fixedAggregator always returns the same snapshot.
+type fixedAggregator map[string]float64
+
+func (a fixedAggregator) Observe(value float64)        {}
+func (a fixedAggregator) Snapshot() map[string]float64 { return a }
+func (a fixedAggregator) Reset()                       {}
+
+func TestWriteSnapshotCollisions(t *testing.T) {
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterCustom("fixed", func() Aggregator {
+		return fixedAggregator{"a b": 1, "a_b": 2, "a\nb": 3, "c": 4}
+	}, MetricIdleZeros(true))
+
+	// "a\nb", "a b" and "a_b" are all sent as a_b: the first suffix in sorted order wins on every flush
+	for i := 0; i < 3; i++ {
+		graph.buffer.Reset()
+		graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+		expected := []string{
+			"prefix.fixed.a_b 3.000000000000 946782245",
+			"prefix.fixed.c 4.000000000000 946782245",
+		}
+		assertLines(t, graph.buffer.String(), expected)
+	}
+
+	if !strings.Contains(logOutput.String(), "duplicates series fixed.a_b") {
+		t.Errorf("Expected the duplicate suffixes logged, got \"%v\"", logOutput.String())
+	}
+}
+
+func TestSanitizeSuffix(t *testing.T) {
+	tests := []struct {
+		suffix   string
+		expected string
+	}{
+		{"p99", "p99"},
+		{"by_code.500", "by_code.500"},
+		{"bad suffix\nprefix.fake 1 0", "bad_suffix_prefix.fake_1_0"},
+		{"a..b.", "a._.b._"},
+	}
+
+	for _, test := range tests {
+		if suffix := sanitizeSuffix(test.suffix); suffix != test.expected {
+			t.Errorf("Expected %v, got %v", test.expected, suffix)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package graphite
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// LinearBuckets returns n histogram ranges, the first is start and each next one is width greater.
+// It returns nil if n < 1 or width <= 0.
+func LinearBuckets(start, width float64, n int) []float64 {
+	if n < 1 || width <= 0 {
+		return nil
+	}
+
+	ranges := make([]float64, n)
+	for i := range ranges {
+		ranges[i] = start + float64(i)*width
+	}
+	return ranges
+}
+
+// ExponentialBuckets returns n histogram ranges, the first is start and each next one is factor times greater.
+// It returns nil if n < 1, start <= 0 or factor <= 1.
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	if n < 1 || start <= 0 || factor <= 1 {
+		return nil
+	}
+
+	ranges := make([]float64, n)
+	for i := range ranges {
+		ranges[i] = start * math.Pow(factor, float64(i))
+	}
+	return ranges
+}
+
+// DurationBuckets converts the durations to histogram ranges in units of unit, for example for a timer registered with the same unit:
+// DurationBuckets(time.Millisecond, 10*time.Millisecond, 100*time.Millisecond, time.Second) returns [10, 100, 1000].
+// It returns nil if unit <= 0.
+func DurationBuckets(unit time.Duration, bounds ...time.Duration) []float64 {
+	if unit <= 0 || len(bounds) == 0 {
+		return nil
+	}
+
+	ranges := make([]float64, len(bounds))
+	for i, d := range bounds {
+		ranges[i] = float64(d) / float64(unit)
+	}
+	return ranges
+}
+
+// checkHistRanges checks that the histogram ranges are non-empty, finite and strictly increasing.
+func checkHistRanges(histRanges []float64) error {
+	if len(histRanges) == 0 {
+		return fmt.Errorf("Empty histogram ranges")
+	}
+
+	for i, v := range histRanges {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("Histogram range %v isn't finite", v)
+		}
+
+		if i > 0 && v <= histRanges[i-1] {
+			return fmt.Errorf("Histogram ranges aren't strictly increasing: %v after %v", v, histRanges[i-1])
+		}
+	}
+	return nil
+}
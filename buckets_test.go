@@ -0,0 +1,65 @@
+package graphite
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLinearBuckets(t *testing.T) {
+	ranges := LinearBuckets(10, 5, 4)
+	if !reflect.DeepEqual(ranges, []float64{10, 15, 20, 25}) {
+		t.Errorf("Expected [10 15 20 25], got %v", ranges)
+	}
+
+	if ranges = LinearBuckets(10, 0, 4); ranges != nil {
+		t.Errorf("Expected nil for zero width, got %v", ranges)
+	}
+
+	if ranges = LinearBuckets(10, 5, 0); ranges != nil {
+		t.Errorf("Expected nil for zero n, got %v", ranges)
+	}
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	ranges := ExponentialBuckets(1, 10, 4)
+	if !reflect.DeepEqual(ranges, []float64{1, 10, 100, 1000}) {
+		t.Errorf("Expected [1 10 100 1000], got %v", ranges)
+	}
+
+	if ranges = ExponentialBuckets(1, 1, 4); ranges != nil {
+		t.Errorf("Expected nil for factor 1, got %v", ranges)
+	}
+
+	if ranges = ExponentialBuckets(0, 2, 4); ranges != nil {
+		t.Errorf("Expected nil for zero start, got %v", ranges)
+	}
+}
+
+func TestDurationBuckets(t *testing.T) {
+	ranges := DurationBuckets(time.Millisecond, 500*time.Microsecond, 10*time.Millisecond, time.Second)
+	if !reflect.DeepEqual(ranges, []float64{0.5, 10, 1000}) {
+		t.Errorf("Expected [0.5 10 1000], got %v", ranges)
+	}
+
+	if ranges = DurationBuckets(0, time.Second); ranges != nil {
+		t.Errorf("Expected nil for zero unit, got %v", ranges)
+	}
+}
+
+func TestCheckHistRanges(t *testing.T) {
+	valid := [][]float64{{1}, {-5, 0, 2.5}, LinearBuckets(0, 1, 100)}
+	for _, ranges := range valid {
+		if err := checkHistRanges(ranges); err != nil {
+			t.Errorf("checkHistRanges(%v) got error(%v)", ranges, err)
+		}
+	}
+
+	invalid := [][]float64{nil, {}, {1, 1}, {2, 1}, {1, math.NaN()}, {1, math.Inf(1)}, {math.Inf(-1), 1}}
+	for _, ranges := range invalid {
+		if err := checkHistRanges(ranges); err == nil {
+			t.Errorf("Expected error for %v", ranges)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package graphite
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by Graphite to stamp and schedule flushes.
+// The default clock uses the time package. Use WithClock to replace it, for example with a FakeClock in tests.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker delivers ticks at intervals, just like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer delivers a single tick after a duration, just like time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{time.NewTimer(d)}
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *realTimer) Stop() {
+	t.timer.Stop()
+}
+
+// FakeClock is a manual Clock. Time stands still until Advance is called, which makes flush timing deterministic in tests.
+// Multiple goroutines may invoke methods on a FakeClock simultaneously.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// fakeTicker is also used for timers, which have a zero period.
+type fakeTicker struct {
+	clock  *FakeClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+// NewFakeClock creates a new FakeClock, which shows the time now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// NewTicker creates a ticker, which fires each time the clock is advanced past a multiple of d since the creation of the ticker.
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("graphite: non-positive interval for FakeClock.NewTicker")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// NewTimer creates a timer, which fires once the clock is advanced by d. A timer with a non-positive d fires immediately.
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), next: c.now.Add(d)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and fires all tickers that became due in chronological order.
+// As with time.Ticker, a tick is dropped if the previous one has not been received yet.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	end := c.now.Add(d)
+	for {
+		due := c.dueTickers(end)
+		if len(due) == 0 {
+			break
+		}
+
+		t := due[0]
+		c.now = t.next
+		select {
+		case t.c <- t.next:
+		default:
+		}
+		if t.period == 0 {
+			c.remove(t)
+		}
+		t.next = t.next.Add(t.period)
+	}
+	c.now = end
+}
+
+func (c *FakeClock) remove(t *fakeTicker) {
+	for i, v := range c.tickers {
+		if v == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			break
+		}
+	}
+}
+
+func (c *FakeClock) dueTickers(end time.Time) []*fakeTicker {
+	var due []*fakeTicker
+	for _, t := range c.tickers {
+		if !t.next.After(end) {
+			due = append(due, t)
+		}
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].next.Before(due[j].next)
+	})
+	return due
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(t)
+}
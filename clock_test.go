@@ -0,0 +1,101 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockNow(t *testing.T) {
+	start := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	if !clock.Now().Equal(start) {
+		t.Errorf("Expected %v, got %v", start, clock.Now())
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	if !clock.Now().Equal(start.Add(1500 * time.Millisecond)) {
+		t.Errorf("Expected %v, got %v", start.Add(1500*time.Millisecond), clock.Now())
+	}
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	start := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := NewFakeClock(start)
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case tm := <-ticker.C():
+		t.Errorf("Unexpected tick %v", tm)
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case tm := <-ticker.C():
+		if !tm.Equal(start.Add(time.Second)) {
+			t.Errorf("Expected tick %v, got %v", start.Add(time.Second), tm)
+		}
+	default:
+		t.Error("Expected tick after 1s")
+	}
+
+	// Ticks are dropped while the channel is full
+	clock.Advance(3 * time.Second)
+	tm := <-ticker.C()
+	if !tm.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("Expected tick %v, got %v", start.Add(2*time.Second), tm)
+	}
+
+	select {
+	case tm := <-ticker.C():
+		t.Errorf("Unexpected tick %v", tm)
+	default:
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Second)
+	select {
+	case tm := <-ticker.C():
+		t.Errorf("Unexpected tick %v after Stop()", tm)
+	default:
+	}
+}
+
+func TestFakeClockTimer(t *testing.T) {
+	start := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := NewFakeClock(start)
+	timer := clock.NewTimer(2 * time.Second)
+
+	clock.Advance(time.Second)
+	select {
+	case tm := <-timer.C():
+		t.Errorf("Unexpected tick %v", tm)
+	default:
+	}
+
+	clock.Advance(5 * time.Second)
+	select {
+	case tm := <-timer.C():
+		if !tm.Equal(start.Add(2 * time.Second)) {
+			t.Errorf("Expected tick %v, got %v", start.Add(2*time.Second), tm)
+		}
+	default:
+		t.Error("Expected tick after 2s")
+	}
+
+	clock.Advance(5 * time.Second)
+	select {
+	case tm := <-timer.C():
+		t.Errorf("Unexpected second tick %v", tm)
+	default:
+	}
+
+	timer = clock.NewTimer(0)
+	select {
+	case <-timer.C():
+	default:
+		t.Error("Expected immediate tick for zero duration")
+	}
+}
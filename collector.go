@@ -0,0 +1,83 @@
+package graphite
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// Collector reports the values of metrics, such as queue lengths or pool stats, right before each flush.
+// The report function may be called for any registered metric any number of times; the values are processed as with HandleValue.
+// A collector is called from its own goroutine. If it doesn't return in the collect timeout (see WithCollectTimeout),
+// its values are discarded and it isn't called again until it returns. A panic in a collector is recovered and logged.
+type Collector interface {
+	Collect(report func(name string, value float64))
+}
+
+// CollectorFunc is an adapter to use an ordinary function as a Collector.
+type CollectorFunc func(report func(name string, value float64))
+
+// Collect calls f(report).
+func (f CollectorFunc) Collect(report func(name string, value float64)) {
+	f(report)
+}
+
+type collectorState struct {
+	collector Collector
+	running   int32
+}
+
+func (cs *collectorState) run(done chan<- []graphiteValue) {
+	var values []graphiteValue
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Graphite.collect: Collector panic: %v", r)
+			values = nil
+		}
+		done <- values
+		atomic.StoreInt32(&cs.running, 0)
+	}()
+
+	cs.collector.Collect(func(name string, value float64) {
+		values = append(values, graphiteValue{name: name, value: value})
+	})
+}
+
+// collect calls all collectors and processes their values. It waits for the collectors no longer than collectTimeout.
+func (gr *Graphite) collect() {
+	if len(gr.collectors) == 0 {
+		return
+	}
+
+	done := make(chan []graphiteValue, len(gr.collectors))
+	started := 0
+	for _, cs := range gr.collectors {
+		if !atomic.CompareAndSwapInt32(&cs.running, 0, 1) {
+			log.Printf("Graphite.collect: Previous call of collector %T is still running", cs.collector)
+			continue
+		}
+		started++
+		go cs.run(done)
+	}
+
+	timer := gr.clock.NewTimer(gr.collectTimeout)
+	defer timer.Stop()
+	for ; started > 0; started-- {
+		select {
+		case values := <-done:
+			for _, v := range values {
+				mt, ok := gr.metrics[v.name]
+				if !ok {
+					log.Printf("Graphite.collect: Metric %s don't exist", v.name)
+					continue
+				}
+				if value, ok, _ := gr.checkValue(mt, v.name, v.value); ok == true {
+					v.value = value
+					gr.handleValue(v)
+				}
+			}
+		case <-timer.C():
+			log.Printf("Graphite.collect: %d collectors timed out after %v", started, gr.collectTimeout)
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package graphite
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCollector(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	queue := 0.0
+	graph.RegisterGaugeFunc("queue", func() float64 { queue += 5; return queue })
+	graph.RegisterCounterFunc("bytes", false, func() float64 { return 100 })
+	graph.RegisterAverage("pool")
+	graph.RegisterCollector(CollectorFunc(func(report func(string, float64)) {
+		report("pool", 1)
+		report("pool", 3)
+	}))
+	c := new(testConnection)
+	graph.conn = c
+
+	tm := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	graph.sendMetrics(tm)
+	graph.sendMetrics(tm)
+
+	expected := []string{
+		"prefix.bytes 100.000000000000 946782245",
+		"prefix.bytes 100.000000000000 946782245",
+		"prefix.pool 2.000000000000 946782245",
+		"prefix.pool 2.000000000000 946782245",
+		"prefix.queue 10.000000000000 946782245",
+		"prefix.queue 5.000000000000 946782245",
+	}
+	assertLines(t, c.Buffer.String(), expected)
+}
+
+func TestCollectorPanicAndTimeout(t *testing.T) {
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false, WithCollectTimeout(20*time.Millisecond))
+	graph.RegisterGauge("gauge")
+	release := make(chan struct{})
+	var slowCalls int32
+	graph.RegisterGaugeFunc("slow", func() float64 { atomic.AddInt32(&slowCalls, 1); <-release; return 1 })
+	graph.RegisterGaugeFunc("crash", func() float64 { panic("crash") })
+	graph.RegisterCollector(CollectorFunc(func(report func(string, float64)) {
+		report("unknown", 1)
+		report("gauge", 7)
+	}))
+	c := new(testConnection)
+	graph.conn = c
+
+	tm := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	start := time.Now()
+	graph.sendMetrics(tm)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Slow collector stalled the flush for %v", elapsed)
+	}
+
+	// The slow collector isn't called again while it is running
+	graph.sendMetrics(tm)
+	close(release)
+
+	expected := "prefix.gauge 7.000000000000 946782245\nprefix.gauge 7.000000000000 946782245\n"
+	if output := c.Buffer.String(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+
+	if calls := atomic.LoadInt32(&slowCalls); calls != 1 {
+		t.Errorf("Expected 1 call of the slow collector, got %d", calls)
+	}
+
+	for _, s := range []string{"crash", "timed out", "still running", "unknown don't exist"} {
+		if !strings.Contains(logOutput.String(), s) {
+			t.Errorf("Expected \"%v\" in log \"%v\"", s, logOutput.String())
+		}
+	}
+}
+
+func TestCollectorFakeClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false, WithClock(clock), WithCollectTimeout(time.Second))
+	release := make(chan struct{})
+	defer close(release)
+	graph.RegisterGaugeFunc("slow", func() float64 { <-release; return 1 })
+
+	done := make(chan struct{})
+	go func() {
+		graph.collect()
+		close(done)
+	}()
+
+	// The timeout doesn't expire in real time
+	select {
+	case <-done:
+		t.Fatal("collect() returned before the fake clock was advanced")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("collect() didn't return after the fake clock was advanced by the timeout")
+	}
+}
@@ -0,0 +1,28 @@
+package graphite
+
+// GaugeMetric changes the value of a gauge registered with RegisterPersistentGauge.
+// Multiple goroutines may invoke methods on a GaugeMetric simultaneously.
+type GaugeMetric struct {
+	graphite *Graphite
+	name     string
+}
+
+// Set sets the value of the gauge.
+func (g *GaugeMetric) Set(value float64) error {
+	return g.graphite.sendValue(graphiteValue{name: g.name, value: value})
+}
+
+// Add adds delta to the value of the gauge.
+func (g *GaugeMetric) Add(delta float64) error {
+	return g.graphite.sendValue(graphiteValue{name: g.name, value: delta, op: opAdd})
+}
+
+// Inc increments the value of the gauge by one.
+func (g *GaugeMetric) Inc() error {
+	return g.Add(1)
+}
+
+// Dec decrements the value of the gauge by one.
+func (g *GaugeMetric) Dec() error {
+	return g.Add(-1)
+}
@@ -0,0 +1,87 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPersistentGauge(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock))
+	gauge, err := graph.RegisterPersistentGauge("gauge", 0)
+	if err != nil {
+		t.Errorf("RegisterPersistentGauge() got error(%v)", err)
+	}
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+
+	gauge.Set(5)
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+	gauge.Add(-0.5)
+	clock.Advance(10 * time.Second)
+
+	expected := "prefix.gauge 5.500000000000 946782255\n"
+	if output := c.waitOutput(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+	graph.Stop()
+}
+
+func TestPersistentGaugeTTL(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false)
+	graph.RegisterPersistentGauge("gauge", 25*time.Second)
+	tm := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Nothing is sent before the first update
+	graph.fillBuffer(tm)
+	if graph.buffer.Len() != 0 {
+		t.Errorf("Unexpected output \"%v\"", graph.buffer.String())
+	}
+
+	graph.handleValue(graphiteValue{name: "gauge", value: 2, op: opAdd})
+	for i := 0; i < 5; i++ {
+		graph.fillBuffer(tm)
+	}
+
+	// The value is repeated until it is older than the TTL
+	expected := "prefix.gauge 2.000000000000 946782245\n" +
+		"prefix.gauge 2.000000000000 946782245\n" +
+		"prefix.gauge 2.000000000000 946782245\n"
+	if output := graph.buffer.String(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+
+	graph.buffer.Reset()
+	graph.handleValue(graphiteValue{name: "gauge", value: 1, op: opAdd})
+	graph.fillBuffer(tm)
+	expected = "prefix.gauge 3.000000000000 946782245\n"
+	if output := graph.buffer.String(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+}
+
+func TestRegisterPersistentGauge(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false)
+
+	if _, err := graph.RegisterPersistentGauge("gauge", -time.Second); err == nil {
+		t.Error("Expected error for negative TTL")
+	}
+
+	gauge, err := graph.RegisterPersistentGauge("gauge", time.Minute)
+	if gauge == nil || err != nil {
+		t.Errorf("RegisterPersistentGauge() got error(%v)", err)
+	}
+
+	if err = gauge.Inc(); err == nil {
+		t.Error("Expected error(\"HandleValue: Call Start() before HandleValue()\")")
+	}
+
+	graph, _ = NewGraphite("", 0, "", 0, true)
+	gauge, err = graph.RegisterPersistentGauge("gauge", 0)
+	if err != nil || gauge.Set(1) != nil {
+		t.Errorf("Got error(%v) for disabled graphite", err)
+	}
+}
@@ -6,6 +6,8 @@ package graphite
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"os"
 	"strconv"
 	"time"
 )
@@ -19,6 +21,39 @@ const (
 	metricMinimum
 	metricGauge
 	metricHist
+	metricTimer
+	metricQuantile
+	metricHDR
+	metricPersistentGauge
+	metricDerive
+	metricMeter
+	metricStats
+	metricSet
+	metricTopK
+	metricApdex
+	metricRatio
+	metricCustom
+	metricSummary
+)
+
+// SummaryAggregation is a set of aggregations of a metric registered with RegisterSummary. Combine the values with |.
+type SummaryAggregation int16
+
+const (
+	// SummaryCount sends the number of values as name.count.
+	SummaryCount SummaryAggregation = 1 << iota
+	// SummarySum sends the sum of the values as name.sum.
+	SummarySum
+	// SummaryAvg sends the average of the values as name.avg.
+	SummaryAvg
+	// SummaryMin sends the minimum of the values as name.min.
+	SummaryMin
+	// SummaryMax sends the maximum of the values as name.max.
+	SummaryMax
+	// SummaryLast sends the last value as name.last.
+	SummaryLast
+	// SummaryHist sends the histogram buckets of the values as name.hist.0, name.hist.1 and so on, like RegisterHist.
+	SummaryHist
 )
 
 const (
@@ -26,6 +61,7 @@ const (
 	writeTimeout   = 1 * time.Second
 	maxBufSize     = 5 * 1 << 20 // 5 MiB
 	valuesChanSize = 500000
+	collectTimeout = 100 * time.Millisecond
 )
 
 // Graphite encapsulates an API that allows you to handle metric values and send them to graphite.
@@ -37,11 +73,32 @@ type Graphite struct {
 
 	metrics    map[string]*graphiteMetric
 	conn       connection
-	ticker     *time.Ticker
+	clock      Clock
+	ticker     Ticker
+	timer      Timer
 	tickerChan <-chan time.Time
 	valuesChan chan graphiteValue
 	stopChan   chan struct{}
 
+	aligned     bool
+	windowStamp WindowStamp
+	windowStart time.Time
+
+	sendJitter time.Duration
+	jitterMode JitterMode
+	hostDelay  time.Duration
+	sendTimer  Timer
+	sendChan   <-chan time.Time
+
+	idleZeros bool
+
+	valuePolicy valuePolicy
+	validating  bool
+	valueCounts *valueCounts
+
+	collectors     []*collectorState
+	collectTimeout time.Duration
+
 	buffer   bytes.Buffer
 	disabled bool
 	started  bool
@@ -51,10 +108,12 @@ type Graphite struct {
 // The prefix parameter is assigned to each metric name when it is sent to the graphite server.
 // Graphite sends aggregated metrics to the server each flushInterval period. The flushInterval can't be less than a one second.
 // Sending metrics to the server is easy to disable from the application config without changing the code. Use the disabled option to do this.
-func NewGraphite(host string, port uint16, prefix string, flushInterval time.Duration, disabled bool) (*Graphite, error) {
+// Additional settings, such as the clock, are passed as options.
+func NewGraphite(host string, port uint16, prefix string, flushInterval time.Duration, disabled bool, options ...Option) (*Graphite, error) {
 	if disabled == true {
 		graph := new(Graphite)
 		graph.disabled = true
+		graph.clock = realClock{}
 		graph.metrics = make(map[string]*graphiteMetric)
 		return graph, nil
 	}
@@ -72,43 +131,354 @@ func NewGraphite(host string, port uint16, prefix string, flushInterval time.Dur
 		}
 	}
 	graph.flushInterval = flushInterval
+	graph.clock = realClock{}
+	graph.collectTimeout = collectTimeout
+	graph.valueCounts = new(valueCounts)
 
 	graph.metrics = make(map[string]*graphiteMetric)
 	graph.valuesChan = make(chan graphiteValue, valuesChanSize)
 
+	for _, option := range options {
+		option(graph)
+	}
+
+	if graph.sendJitter < 0 || graph.sendJitter >= flushInterval {
+		return nil, fmt.Errorf("NewGraphite: Send jitter (%v) must be in [0, %v)", graph.sendJitter, flushInterval)
+	}
+
+	if graph.sendJitter > 0 && graph.jitterMode == JitterHostname {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("NewGraphite: Cannot get the hostname for the send jitter: %v", err)
+		}
+		graph.hostDelay = hostnameDelay(hostname, graph.sendJitter)
+	}
+
+	if err := checkValuePolicy(graph.valuePolicy); err != nil {
+		return nil, fmt.Errorf("NewGraphite: %v", err)
+	}
+
 	return graph, nil
 }
 
 // RegisterCounter creates a new named metric that summarizes  all incoming values.
+// All Register* functions accept options, such as MetricInterval, that change the settings of the metric.
 // This metric has a setting of normalizeByInterval which allows you to send a value (summ / period) to graphite.
-func (graphite *Graphite) RegisterCounter(name string, normalizeByInterval bool) error {
-	return graphite.registerMetric(name, metricCounter, normalizeByInterval, []float64{})
+func (graphite *Graphite) RegisterCounter(name string, normalizeByInterval bool, options ...MetricOption) error {
+	return graphite.registerMetric(name, metricCounter, normalizeByInterval, []float64{}, options...)
 }
 
 // RegisterAverage creates a new named metric that calculates the average value over the time interval.
-func (graphite *Graphite) RegisterAverage(name string) error {
-	return graphite.registerMetric(name, metricAverage, false, []float64{})
+func (graphite *Graphite) RegisterAverage(name string, options ...MetricOption) error {
+	return graphite.registerMetric(name, metricAverage, false, []float64{}, options...)
 }
 
 // RegisterMaximum creates a new named metric that calculates the maximum value for the time interval.
-func (graphite *Graphite) RegisterMaximum(name string) error {
-	return graphite.registerMetric(name, metricMaximum, false, []float64{})
+func (graphite *Graphite) RegisterMaximum(name string, options ...MetricOption) error {
+	return graphite.registerMetric(name, metricMaximum, false, []float64{}, options...)
 }
 
 // RegisterMinimum creates a new named metric that calculates the minimum value for the time interval.
-func (graphite *Graphite) RegisterMinimum(name string) error {
-	return graphite.registerMetric(name, metricMinimum, false, []float64{})
+func (graphite *Graphite) RegisterMinimum(name string, options ...MetricOption) error {
+	return graphite.registerMetric(name, metricMinimum, false, []float64{}, options...)
 }
 
 // RegisterGauge creates a new named metric that use the last value.
-func (graphite *Graphite) RegisterGauge(name string) error {
-	return graphite.registerMetric(name, metricGauge, false, []float64{})
+func (graphite *Graphite) RegisterGauge(name string, options ...MetricOption) error {
+	return graphite.registerMetric(name, metricGauge, false, []float64{}, options...)
+}
+
+// RegisterDerive creates a new named counter, which takes monotonically increasing totals (for example, bytes read from /proc) instead of increments.
+// The metric sends the sum of the differences between consecutive totals during the interval, or with perSecond the rate per second.
+// The first total is only a baseline. A total less than the previous one is treated as a reset of the counter
+// and becomes a new baseline, so a restart of the source doesn't produce a spike. Use MetricWrapAt for counters that wrap around.
+func (graphite *Graphite) RegisterDerive(name string, perSecond bool, options ...MetricOption) error {
+	return graphite.registerMetric(name, metricDerive, perSecond, []float64{}, options...)
+}
+
+// RegisterMeter creates a new named metric that measures the rate of events. Each value is the number of events, usually 1.
+// At each flush the meter sends the number of events during the interval as name.count, and the 1-, 5- and 15-minute
+// exponentially weighted moving average rates per second, like the Unix load average, as name.m1_rate, name.m5_rate and name.m15_rate.
+// The moving averages are weighted by the actual time between flushes, so they stay correct if ticks are missed.
+func (graphite *Graphite) RegisterMeter(name string, options ...MetricOption) error {
+	return graphite.registerMetric(name, metricMeter, false, []float64{}, options...)
+}
+
+// RegisterStats creates a new named metric that calculates the statistics of the values over the time interval with Welford's algorithm.
+// At each flush the metric sends name.count, name.mean, name.stddev, name.variance (the population variance), name.min and name.max.
+func (graphite *Graphite) RegisterStats(name string, options ...MetricOption) error {
+	return graphite.registerMetric(name, metricStats, false, []float64{}, options...)
+}
+
+// RegisterSet creates a new named metric that estimates the number of unique members over the time interval, for example unique users,
+// and returns a SetMetric to add string or uint64 members. Values passed to HandleValue are added as members too;
+// a whole value is the same member as the uint64 of the value, so HandleValue(name, 42) and AddUint64(42) count once.
+// The members aren't kept: the metric uses a HyperLogLog sketch of 2^precision bytes, 4 <= precision <= 16,
+// with the standard error of 1.04/sqrt(2^precision), for example 1.6% for precision 12.
+func (graphite *Graphite) RegisterSet(name string, precision uint8, options ...MetricOption) (*SetMetric, error) {
+	if precision < 4 || precision > 16 {
+		return nil, fmt.Errorf("RegisterSet: Precision (%v) isn't in [4, 16]", precision)
+	}
+
+	setOptions := []MetricOption{func(mt *graphiteMetric) {
+		mt.setPrecision = precision
+	}}
+	err := graphite.registerMetric(name, metricSet, false, []float64{}, append(setOptions, options...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SetMetric{graphite, name}, nil
+}
+
+// RegisterTopK creates a new named metric that sends the counts of the k most frequent keys over the time interval as name.<key>,
+// for example the most active client IDs, and returns a TopKMetric to add the keys.
+// At most capacity keys are counted (see the Space-Saving algorithm), so the memory is bounded. The counts may be overestimated by
+// the count of the least frequent key when there are more than capacity different keys in an interval; a capacity of several times k
+// makes the top keys and their counts accurate for skewed distributions. The capacity must be at least k.
+func (graphite *Graphite) RegisterTopK(name string, k int, capacity int, options ...MetricOption) (*TopKMetric, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("RegisterTopK: K (%v) isn't positive", k)
+	}
+	if capacity < k {
+		return nil, fmt.Errorf("RegisterTopK: Capacity (%v) is less than k (%v)", capacity, k)
+	}
+
+	topKOptions := []MetricOption{func(mt *graphiteMetric) {
+		mt.topK = k
+		mt.topKCapacity = capacity
+	}}
+	err := graphite.registerMetric(name, metricTopK, false, []float64{}, append(topKOptions, options...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TopKMetric{graphite, name}, nil
 }
 
 // RegisterHist creates a new named metric that calculates the number of hits of values at predefined intervals.
 // For example: histRanges = [10, 25, 100, 350] for intervals: (... , 10), (10, 25), (25, 100), (100, 350), (350, ...)
-func (graphite *Graphite) RegisterHist(name string, histRanges []float64) error {
-	return graphite.registerMetric(name, metricHist, false, histRanges)
+// The histRanges must be non-empty, finite and strictly increasing. Use LinearBuckets, ExponentialBuckets or DurationBuckets to build them.
+func (graphite *Graphite) RegisterHist(name string, histRanges []float64, options ...MetricOption) error {
+	if err := checkHistRanges(histRanges); err != nil {
+		return fmt.Errorf("RegisterHist: %v", err)
+	}
+
+	return graphite.registerMetric(name, metricHist, false, histRanges, options...)
+}
+
+// RegisterSummary creates a new named metric that sends several aggregations of the same values over the time interval as sub-series,
+// for example name.avg and name.max, instead of registering a metric per aggregation. The histRanges are required by SummaryHist only.
+// In an idle interval only the count, the sum and the histogram follow the idle zeros setting (see MetricIdleZeros).
+func (graphite *Graphite) RegisterSummary(name string, aggregations SummaryAggregation, histRanges []float64, options ...MetricOption) error {
+	if aggregations <= 0 || aggregations >= SummaryHist<<1 {
+		return fmt.Errorf("RegisterSummary: Invalid aggregations (%v)", aggregations)
+	}
+
+	if aggregations&SummaryHist != 0 {
+		if err := checkHistRanges(histRanges); err != nil {
+			return fmt.Errorf("RegisterSummary: %v", err)
+		}
+	} else if len(histRanges) > 0 {
+		return fmt.Errorf("RegisterSummary: Hist ranges without SummaryHist")
+	}
+
+	summaryOptions := []MetricOption{func(mt *graphiteMetric) {
+		mt.aggregations = aggregations
+	}}
+	return graphite.registerMetric(name, metricSummary, false, histRanges, append(summaryOptions, options...)...)
+}
+
+// RegisterTimer creates a new named metric that measures durations and returns a TimerMetric to observe them.
+// The durations are converted to float values in units of unit, for example time.Millisecond or time.Microsecond.
+// At each flush the timer sends name.count, name.mean, name.min, name.max, name.sum series and, if histRanges isn't empty,
+// the histogram buckets name.hist.0, name.hist.1 and so on, like RegisterHist with histRanges in units of unit (see DurationBuckets).
+func (graphite *Graphite) RegisterTimer(name string, unit time.Duration, histRanges []float64, options ...MetricOption) (*TimerMetric, error) {
+	if unit <= 0 {
+		return nil, fmt.Errorf("RegisterTimer: Unit (%v) <= 0", unit)
+	}
+
+	if len(histRanges) > 0 {
+		if err := checkHistRanges(histRanges); err != nil {
+			return nil, fmt.Errorf("RegisterTimer: %v", err)
+		}
+	}
+
+	err := graphite.registerMetric(name, metricTimer, false, histRanges, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TimerMetric{graphite, name, unit}, nil
+}
+
+// RegisterApdex creates a new named metric that calculates the Apdex score of response times over the time interval for the target threshold.
+// A value is satisfied if it is at most threshold, tolerating if it is at most 4*threshold and frustrated otherwise, in the units of the values.
+// At each flush the metric sends name.score = (satisfied + tolerating/2) / count together with name.satisfied, name.tolerating and name.frustrated counts.
+func (graphite *Graphite) RegisterApdex(name string, threshold float64, options ...MetricOption) error {
+	if !(threshold > 0) {
+		return fmt.Errorf("RegisterApdex: Threshold (%v) isn't positive", threshold)
+	}
+
+	apdexOptions := []MetricOption{func(mt *graphiteMetric) {
+		mt.apdexThreshold = threshold
+	}}
+	return graphite.registerMetric(name, metricApdex, false, []float64{}, append(apdexOptions, options...)...)
+}
+
+// RegisterRatio creates a new named metric for ratios such as the error rate or the cache hit ratio and returns a RatioMetric to count hits and misses.
+// A non-zero value passed to HandleValue is a hit and zero is a miss. At each flush the metric sends name.numerator (hits),
+// name.denominator (hits and misses) and name.ratio = numerator / denominator. The ratio isn't sent for an interval
+// without events, since 0/0 has no meaningful value; the counts follow the idle zeros setting (see MetricIdleZeros).
+func (graphite *Graphite) RegisterRatio(name string, options ...MetricOption) (*RatioMetric, error) {
+	err := graphite.registerMetric(name, metricRatio, false, []float64{}, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RatioMetric{graphite, name}, nil
+}
+
+// RegisterCustom creates a new named metric with a user-defined aggregation. The factory is called to create an Aggregator
+// for the metric and for each of its resolutions. At each flush of an interval with values the metric sends the Snapshot
+// of the Aggregator and then resets it. With the idle zeros setting (see MetricIdleZeros) the Snapshot is sent for idle intervals too.
+func (graphite *Graphite) RegisterCustom(name string, factory func() Aggregator, options ...MetricOption) error {
+	if factory == nil {
+		return fmt.Errorf("RegisterCustom: No factory for metric %s", name)
+	}
+
+	customOptions := []MetricOption{func(mt *graphiteMetric) {
+		mt.aggregatorFactory = factory
+	}}
+	return graphite.registerMetric(name, metricCustom, false, []float64{}, append(customOptions, options...)...)
+}
+
+// RegisterQuantile creates a new named metric that estimates quantiles of the values over the time interval.
+// At each flush the metric sends a series for each of quantiles, named after the percentile: name.p50, name.p99, name.p999 for 0.5, 0.99 and 0.999.
+// The quantiles are estimated with a DDSketch, which uses bounded memory and guarantees the relative error of at most relativeAccuracy,
+// for example 0.01 for 1%, as long as the values span less than 2048 bins (17 orders of magnitude with 1% accuracy).
+// Values closer to zero than 1e-9 are treated as zero.
+func (graphite *Graphite) RegisterQuantile(name string, quantiles []float64, relativeAccuracy float64, options ...MetricOption) error {
+	if relativeAccuracy <= 0 || relativeAccuracy >= 1 {
+		return fmt.Errorf("RegisterQuantile: Relative accuracy (%v) isn't in (0, 1)", relativeAccuracy)
+	}
+
+	if len(quantiles) == 0 {
+		return fmt.Errorf("RegisterQuantile: No quantiles for metric %s", name)
+	}
+
+	if err := checkQuantiles(quantiles); err != nil {
+		return fmt.Errorf("RegisterQuantile: %v", err)
+	}
+
+	quantileOptions := []MetricOption{func(mt *graphiteMetric) {
+		mt.quantiles = append([]float64(nil), quantiles...)
+		mt.relativeAccuracy = relativeAccuracy
+	}}
+	return graphite.registerMetric(name, metricQuantile, false, []float64{}, append(quantileOptions, options...)...)
+}
+
+// RegisterHDRHist creates a new named histogram with automatic log-linear buckets, like HdrHistogram.
+// The values are counted in units of lowestValue with significantDigits (1-5) decimal digits of precision,
+// so the error of a value is at most lowestValue/2 or 10^-significantDigits of the value. Negative values are counted as zeros.
+// Values above highestValue are counted as highestValue. The histogram has an 8-byte counter for each bucket up to the largest value seen,
+// so it takes up to about 16KB for lowestValue 0.001, highestValue 3600 and 2 digits, 104KB with 3 digits and 6MB with 5 digits,
+// and each resolution of the metric has its own histogram.
+// At flush the histogram is collapsed into a fixed number of series: name.count, a series for each of quantiles (name.p50, name.p99, ...)
+// and, if histRanges isn't empty, the buckets of histRanges like RegisterHist. The quantiles or the histRanges may be empty, but not both.
+func (graphite *Graphite) RegisterHDRHist(name string, lowestValue float64, highestValue float64, significantDigits int, quantiles []float64, histRanges []float64, options ...MetricOption) error {
+	if !(lowestValue > 0) || math.IsInf(lowestValue, 0) {
+		return fmt.Errorf("RegisterHDRHist: Lowest value (%v) <= 0", lowestValue)
+	}
+
+	if !(highestValue >= 2*lowestValue) || highestValue/lowestValue >= hdrMaxUnits {
+		return fmt.Errorf("RegisterHDRHist: Highest value (%v) isn't in [2, 2^62) lowest values", highestValue)
+	}
+
+	if significantDigits < 1 || significantDigits > 5 {
+		return fmt.Errorf("RegisterHDRHist: Significant digits (%v) isn't in [1, 5]", significantDigits)
+	}
+
+	if len(quantiles) == 0 && len(histRanges) == 0 {
+		return fmt.Errorf("RegisterHDRHist: No quantiles and ranges for metric %s", name)
+	}
+
+	if err := checkQuantiles(quantiles); err != nil {
+		return fmt.Errorf("RegisterHDRHist: %v", err)
+	}
+
+	if len(histRanges) > 0 {
+		if err := checkHistRanges(histRanges); err != nil {
+			return fmt.Errorf("RegisterHDRHist: %v", err)
+		}
+	}
+
+	hdrOptions := []MetricOption{func(mt *graphiteMetric) {
+		mt.quantiles = append([]float64(nil), quantiles...)
+		mt.hdrLowest = lowestValue
+		mt.hdrHighest = highestValue
+		mt.hdrDigits = significantDigits
+	}}
+	return graphite.registerMetric(name, metricHDR, false, histRanges, append(hdrOptions, options...)...)
+}
+
+// RegisterPersistentGauge creates a new named gauge that keeps its last value and returns a GaugeMetric to change it.
+// Unlike RegisterGauge, the gauge sends its value at each flush even if it wasn't updated during the interval,
+// and the value may be changed relatively with Add, Inc and Dec. If ttl > 0, the gauge stops sending the value when it
+// hasn't been updated for ttl (rounded up to the flush interval of the gauge) and resumes with the next update.
+func (graphite *Graphite) RegisterPersistentGauge(name string, ttl time.Duration, options ...MetricOption) (*GaugeMetric, error) {
+	if ttl < 0 {
+		return nil, fmt.Errorf("RegisterPersistentGauge: TTL (%v) < 0", ttl)
+	}
+
+	gaugeOptions := []MetricOption{func(mt *graphiteMetric) {
+		mt.ttl = ttl
+	}}
+	err := graphite.registerMetric(name, metricPersistentGauge, false, []float64{}, append(gaugeOptions, options...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GaugeMetric{graphite, name}, nil
+}
+
+// RegisterGaugeFunc creates a new named gauge, which gets its value from f right before each flush.
+func (graphite *Graphite) RegisterGaugeFunc(name string, f func() float64, options ...MetricOption) error {
+	err := graphite.RegisterGauge(name, options...)
+	if err != nil {
+		return err
+	}
+
+	return graphite.RegisterCollector(CollectorFunc(func(report func(string, float64)) {
+		report(name, f())
+	}))
+}
+
+// RegisterCounterFunc creates a new named counter, which gets a value to add from f right before each flush.
+func (graphite *Graphite) RegisterCounterFunc(name string, normalizeByInterval bool, f func() float64, options ...MetricOption) error {
+	err := graphite.RegisterCounter(name, normalizeByInterval, options...)
+	if err != nil {
+		return err
+	}
+
+	return graphite.RegisterCollector(CollectorFunc(func(report func(string, float64)) {
+		report(name, f())
+	}))
+}
+
+// RegisterCollector adds a collector, which is called right before each flush. The metrics it reports must be registered.
+// RegisterCollector should be called before Start.
+func (graphite *Graphite) RegisterCollector(collector Collector) error {
+	if graphite == nil || graphite.metrics == nil {
+		return fmt.Errorf("RegisterCollector: Call NewGraphite() before RegisterCollector()")
+	}
+
+	if graphite.disabled == true {
+		return nil
+	}
+
+	graphite.collectors = append(graphite.collectors, &collectorState{collector: collector})
+	return nil
 }
 
 // Start creates a goroutine, which sends the aggregated metrics to graphite.
@@ -127,8 +497,14 @@ func (graphite *Graphite) Start() error {
 	}
 
 	graphite.stopChan = make(chan struct{})
-	graphite.ticker = time.NewTicker(graphite.flushInterval)
-	graphite.tickerChan = graphite.ticker.C
+	if graphite.aligned == true {
+		now := graphite.clock.Now()
+		graphite.windowStart = alignTime(now, graphite.flushInterval)
+		graphite.scheduleFlush(now)
+	} else {
+		graphite.ticker = graphite.clock.NewTicker(graphite.flushInterval)
+		graphite.tickerChan = graphite.ticker.C()
+	}
 	go graphite.handleChans()
 	graphite.started = true
 
@@ -149,6 +525,9 @@ func (graphite *Graphite) Stop() error {
 		return fmt.Errorf("Stop: Call Start() before Stop()")
 	}
 
+	if graphite.ticker != nil {
+		graphite.ticker.Stop()
+	}
 	close(graphite.stopChan)
 
 	return nil
@@ -156,22 +535,5 @@ func (graphite *Graphite) Stop() error {
 
 // HandleValue processes the new value for the metric.
 func (graphite *Graphite) HandleValue(name string, value float64) error {
-	if graphite == nil || graphite.metrics == nil {
-		return fmt.Errorf("HandleValue: Call NewGraphite() before HandleValue()")
-	}
-
-	if graphite.disabled == true {
-		return nil
-	}
-
-	if graphite.started != true {
-		return fmt.Errorf("HandleValue: Call Start() before HandleValue()")
-	}
-
-	if _, ok := graphite.metrics[name]; !ok {
-		return fmt.Errorf("HandleValue: Metric %s don't exist", name)
-	}
-
-	graphite.valuesChan <- graphiteValue{name, value}
-	return nil
+	return graphite.sendValue(graphiteValue{name: name, value: value})
 }
@@ -1,6 +1,7 @@
 package graphite
 
 import (
+	"math"
 	"testing"
 	"time"
 )
@@ -56,6 +57,11 @@ func TestNewGraphite(t *testing.T) {
 	if graph.prefix != "prefix." {
 		t.Errorf("Expected prefix \"prefix.\", got \"%v\"", graph.prefix)
 	}
+
+	graph, err = NewGraphite("localhost", 0, "prefix", 2*time.Second, false, WithSendJitter(2*time.Second, JitterRandom))
+	if graph != nil || err == nil {
+		t.Error("Expected error for send jitter >= flush interval")
+	}
 }
 
 func TestStart(t *testing.T) {
@@ -213,6 +219,38 @@ func TestRegisterCounter(t *testing.T) {
 	}
 }
 
+func TestRegisterMetricInterval(t *testing.T) {
+	graph, _ := NewGraphite("localhost", 0, "prefix", 2*time.Second, false)
+
+	err := graph.RegisterCounter("counter1", true, MetricInterval(4*time.Second))
+	if err != nil {
+		t.Errorf("graph.RegisterCounter() got error(%v)", err)
+	}
+
+	if graph.metrics["counter1"].flushInterval != 4*time.Second {
+		t.Error("Expected flushInterval 4s, got ", graph.metrics["counter1"].flushInterval)
+	}
+
+	err = graph.RegisterCounter("counter2", true, MetricInterval(3*time.Second))
+	if err == nil {
+		t.Error("Expected error for flush interval, which isn't a multiple of 2s")
+	}
+}
+
+func TestRegisterDerive(t *testing.T) {
+	graph, _ := NewGraphite("localhost", 0, "prefix", 2*time.Second, false)
+	err := graph.RegisterDerive("bytes", true, MetricWrapAt(1<<32))
+
+	if err != nil {
+		t.Errorf("graph.RegisterDerive() got error(%v)", err)
+	}
+
+	metric := graph.metrics["bytes"]
+	if metric.mType != metricDerive || metric.normalizeByInterval != true || metric.wrapAt != 1<<32 {
+		t.Error("Expected metricDerive, got ", metric.mType)
+	}
+}
+
 func TestRegisterAverage(t *testing.T) {
 	graph, _ := NewGraphite("localhost", 0, "prefix", 2*time.Second, false)
 	err := graph.RegisterAverage("average")
@@ -268,6 +306,182 @@ func TestRegisterHist(t *testing.T) {
 	if err == nil {
 		t.Errorf("Expected error(\"RegisterMetric: Metric hist already exist\")")
 	}
+
+	err = graph.RegisterHist("hist2", []float64{1, 3, 2})
+	if err == nil {
+		t.Error("Expected error for unsorted ranges")
+	}
+
+	// The ranges are copied
+	ranges := []float64{1, 2, 3}
+	graph.RegisterHist("hist3", ranges)
+	ranges[0] = 5
+	if graph.metrics["hist3"].histRanges[0] != 1 {
+		t.Errorf("Expected copy of ranges, got %v", graph.metrics["hist3"].histRanges)
+	}
+}
+
+func TestRegisterQuantile(t *testing.T) {
+	graph, _ := NewGraphite("localhost", 0, "prefix", 2*time.Second, false)
+
+	err := graph.RegisterQuantile("quantile", []float64{0.5, 0.99}, 0.01)
+	if err != nil {
+		t.Errorf("graph.RegisterQuantile() got error(%v)", err)
+	}
+
+	metric := graph.metrics["quantile"]
+	if metric.mType != metricQuantile || metric.sketch == nil {
+		t.Error("Expected metricQuantile with sketch, got ", metric.mType)
+	}
+
+	if err = graph.RegisterQuantile("q1", []float64{0.5}, 0); err == nil {
+		t.Error("Expected error for zero accuracy")
+	}
+
+	if err = graph.RegisterQuantile("q2", []float64{}, 0.01); err == nil {
+		t.Error("Expected error for empty quantiles")
+	}
+
+	if err = graph.RegisterQuantile("q3", []float64{1.5}, 0.01); err == nil {
+		t.Error("Expected error for quantile > 1")
+	}
+
+	if err = graph.RegisterQuantile("q4", []float64{0.5, 0.5}, 0.01); err == nil {
+		t.Error("Expected error for duplicate quantile")
+	}
+}
+
+func TestRegisterHDRHist(t *testing.T) {
+	graph, _ := NewGraphite("localhost", 0, "prefix", 2*time.Second, false)
+
+	err := graph.RegisterHDRHist("hdr", 0.001, 3600, 3, []float64{0.5, 0.99}, nil)
+	if err != nil {
+		t.Errorf("graph.RegisterHDRHist() got error(%v)", err)
+	}
+
+	metric := graph.metrics["hdr"]
+	if metric.mType != metricHDR || metric.hdr == nil {
+		t.Error("Expected metricHDR with histogram, got ", metric.mType)
+	}
+
+	if err = graph.RegisterHDRHist("h1", 0, 3600, 3, []float64{0.5}, nil); err == nil {
+		t.Error("Expected error for zero lowest value")
+	}
+
+	if err = graph.RegisterHDRHist("h2", 1, 3600, 6, []float64{0.5}, nil); err == nil {
+		t.Error("Expected error for 6 significant digits")
+	}
+
+	if err = graph.RegisterHDRHist("h3", 1, 3600, 3, nil, nil); err == nil {
+		t.Error("Expected error for no quantiles and ranges")
+	}
+
+	if err = graph.RegisterHDRHist("h4", 1, 3600, 3, nil, []float64{2, 1}); err == nil {
+		t.Error("Expected error for unsorted ranges")
+	}
+
+	if err = graph.RegisterHDRHist("h5", 1, 1.5, 3, []float64{0.5}, nil); err == nil {
+		t.Error("Expected error for highest value < 2 * lowest value")
+	}
+
+	if err = graph.RegisterHDRHist("h6", 1, math.Inf(1), 3, []float64{0.5}, nil); err == nil {
+		t.Error("Expected error for infinite highest value")
+	}
+}
+
+func TestRegisterSummary(t *testing.T) {
+	graph, _ := NewGraphite("localhost", 0, "prefix", 2*time.Second, false)
+
+	err := graph.RegisterSummary("summary", SummaryAvg|SummaryHist, []float64{1, 2})
+	if err != nil {
+		t.Errorf("graph.RegisterSummary() got error(%v)", err)
+	}
+
+	metric := graph.metrics["summary"]
+	if metric.mType != metricSummary || metric.aggregations != SummaryAvg|SummaryHist || len(metric.hist) != 3 {
+		t.Error("Expected metricSummary with avg and hist, got ", metric.mType)
+	}
+
+	if err = graph.RegisterSummary("s1", 0, nil); err == nil {
+		t.Error("Expected error for no aggregations")
+	}
+
+	if err = graph.RegisterSummary("s2", SummaryHist<<1, nil); err == nil {
+		t.Error("Expected error for unknown aggregation")
+	}
+
+	if err = graph.RegisterSummary("s3", SummaryHist, nil); err == nil {
+		t.Error("Expected error for hist without ranges")
+	}
+
+	if err = graph.RegisterSummary("s4", SummaryAvg, []float64{1}); err == nil {
+		t.Error("Expected error for ranges without hist")
+	}
+}
+
+func TestRegisterApdex(t *testing.T) {
+	graph, _ := NewGraphite("localhost", 0, "prefix", 2*time.Second, false)
+
+	if err := graph.RegisterApdex("apdex", 0.5); err != nil {
+		t.Errorf("graph.RegisterApdex() got error(%v)", err)
+	}
+
+	metric := graph.metrics["apdex"]
+	if metric.mType != metricApdex || metric.apdexThreshold != 0.5 {
+		t.Error("Expected metricApdex with threshold 0.5, got ", metric.mType)
+	}
+
+	if err := graph.RegisterApdex("a1", 0); err == nil {
+		t.Error("Expected error for zero threshold")
+	}
+
+	if err := graph.RegisterApdex("a2", math.NaN()); err == nil {
+		t.Error("Expected error for NaN threshold")
+	}
+}
+
+func TestRegisterSet(t *testing.T) {
+	graph, _ := NewGraphite("localhost", 0, "prefix", 2*time.Second, false)
+
+	set, err := graph.RegisterSet("users", 12)
+	if err != nil || set == nil {
+		t.Errorf("graph.RegisterSet() got error(%v)", err)
+	}
+
+	metric := graph.metrics["users"]
+	if metric.mType != metricSet || len(metric.set.registers) != 4096 {
+		t.Error("Expected metricSet with 4096 registers, got ", metric.mType)
+	}
+
+	if _, err = graph.RegisterSet("s1", 3); err == nil {
+		t.Error("Expected error for precision 3")
+	}
+
+	if _, err = graph.RegisterSet("s2", 17); err == nil {
+		t.Error("Expected error for precision 17")
+	}
+}
+
+func TestRegisterTopK(t *testing.T) {
+	graph, _ := NewGraphite("localhost", 0, "prefix", 2*time.Second, false)
+
+	top, err := graph.RegisterTopK("clients", 10, 100)
+	if err != nil || top == nil {
+		t.Errorf("graph.RegisterTopK() got error(%v)", err)
+	}
+
+	metric := graph.metrics["clients"]
+	if metric.mType != metricTopK || metric.topKeys == nil || metric.topK != 10 {
+		t.Error("Expected metricTopK with 10 keys, got ", metric.mType)
+	}
+
+	if _, err = graph.RegisterTopK("t1", 0, 100); err == nil {
+		t.Error("Expected error for zero k")
+	}
+
+	if _, err = graph.RegisterTopK("t2", 10, 5); err == nil {
+		t.Error("Expected error for capacity less than k")
+	}
 }
 
 func BenchmarkHandleValue(b *testing.B) {
@@ -0,0 +1,133 @@
+package graphite
+
+import (
+	"math"
+	"math/bits"
+)
+
+const hdrMaxUnits = 1 << 62
+
+// hdrHistogram is a log-linear histogram like HdrHistogram.
+// Values are converted to integer units of lowest. Units below subBucketCount are counted in linear buckets of width 1.
+// Above that each power of two [2^k, 2^(k+1)) is split into subBucketCount/2 linear buckets,
+// so the width of a bucket is never more than 2/subBucketCount of its values.
+// Values above highest are clamped to it, so the counters never outgrow size().
+type hdrHistogram struct {
+	lowest        float64
+	highest       float64
+	subBucketBits int
+	subBucketHalf int
+	counts        []int64
+	count         int64
+	min           float64
+	max           float64
+}
+
+func newHDRHistogram(lowest float64, highest float64, significantDigits int) *hdrHistogram {
+	h := new(hdrHistogram)
+	h.lowest = lowest
+	h.highest = highest
+	h.subBucketBits = int(math.Ceil(math.Log2(2 * math.Pow10(significantDigits))))
+	h.subBucketHalf = 1 << uint(h.subBucketBits-1)
+	return h
+}
+
+func (h *hdrHistogram) add(value float64) {
+	if !(value > 0) {
+		value = 0
+	} else if value > h.highest {
+		value = h.highest
+	}
+
+	i := h.index(value)
+	if i >= len(h.counts) {
+		h.counts = append(h.counts, make([]int64, i+1-len(h.counts))...)
+	}
+	h.counts[i] += 1
+
+	if h.count == 0 || value < h.min {
+		h.min = value
+	}
+	if h.count == 0 || value > h.max {
+		h.max = value
+	}
+	h.count += 1
+}
+
+func (h *hdrHistogram) index(value float64) int {
+	x := uint64(value / h.lowest)
+	shift := bits.Len64(x) - h.subBucketBits
+	if shift <= 0 {
+		return int(x)
+	}
+	return shift*h.subBucketHalf + int(x>>uint(shift))
+}
+
+// size returns the number of counters needed for the values up to highest.
+func (h *hdrHistogram) size() int {
+	return h.index(h.highest) + 1
+}
+
+// bucketRange returns the lower and the upper (exclusive) bounds of the bucket.
+func (h *hdrHistogram) bucketRange(index int) (float64, float64) {
+	if index < 2*h.subBucketHalf {
+		return float64(index) * h.lowest, float64(index+1) * h.lowest
+	}
+
+	shift := uint(index/h.subBucketHalf - 1)
+	sub := uint64(index - int(shift)*h.subBucketHalf)
+	return float64(sub<<shift) * h.lowest, float64((sub+1)<<shift) * h.lowest
+}
+
+// bucketValue returns the middle of the bucket limited by the minimum and the maximum value of the histogram.
+func (h *hdrHistogram) bucketValue(index int) float64 {
+	lower, upper := h.bucketRange(index)
+	return math.Max(h.min, math.Min(h.max, (lower+upper)/2))
+}
+
+// quantile returns the estimation of the q-quantile, 0 <= q <= 1.
+func (h *hdrHistogram) quantile(q float64) float64 {
+	switch {
+	case h.count == 0:
+		return 0
+	case q <= 0:
+		return h.min
+	case q >= 1:
+		return h.max
+	}
+
+	rank := int64(q * float64(h.count-1))
+	var n int64
+	for i, c := range h.counts {
+		n += c
+		if n > rank {
+			return h.bucketValue(i)
+		}
+	}
+	return h.max
+}
+
+// collapse counts the values of the histogram in the buckets of histRanges, as graphiteMetric.handleHist does.
+func (h *hdrHistogram) collapse(histRanges []float64, hist []int64) {
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+
+		v := h.bucketValue(i)
+		j := 0
+		for j < len(histRanges) && v >= histRanges[j] {
+			j++
+		}
+		hist[j] += c
+	}
+}
+
+func (h *hdrHistogram) reset() {
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.count = 0
+	h.min = 0
+	h.max = 0
+}
@@ -0,0 +1,91 @@
+package graphite
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestHDRBuckets(t *testing.T) {
+	h := newHDRHistogram(0.001, 1e14, 3)
+	if h.subBucketBits != 11 || h.subBucketHalf != 1024 {
+		t.Errorf("Expected 11 bits and 1024 half sub-buckets, got %v %v", h.subBucketBits, h.subBucketHalf)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		v := math.Exp(r.Float64()*40 - 10)
+		lower, upper := h.bucketRange(h.index(v))
+		if v < lower || v >= upper*(1+1e-12) {
+			t.Fatalf("Value %v isn't in its bucket [%v, %v)", v, lower, upper)
+		}
+
+		if upper-lower > math.Max(h.lowest, v*2e-3)*(1+1e-9) {
+			t.Fatalf("Bucket [%v, %v) of value %v is too wide", lower, upper, v)
+		}
+	}
+}
+
+func TestHDRQuantile(t *testing.T) {
+	h := newHDRHistogram(1, 1e9, 2)
+	r := rand.New(rand.NewSource(2))
+	values := make([]float64, 50000)
+	for i := range values {
+		values[i] = math.Exp(r.NormFloat64()*2 + 6)
+		h.add(values[i])
+	}
+	sort.Float64s(values)
+
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.99, 0.999, 1} {
+		exact := exactQuantile(values, q)
+		estimated := h.quantile(q)
+		if math.Abs(estimated-exact) > math.Max(0.5, 0.01*exact) {
+			t.Errorf("q=%v: expected %v, got %v", q, exact, estimated)
+		}
+	}
+}
+
+func TestHDRBoundedMemory(t *testing.T) {
+	h := newHDRHistogram(0.001, 3600, 3)
+	if h.size() > 14000 {
+		t.Errorf("Expected at most 14000 counters for [0.001, 3600] with 3 digits, got %d", h.size())
+	}
+
+	h.add(-5)
+	h.add(1e6)
+	h.add(math.MaxFloat64)
+	h.add(math.Inf(1))
+
+	if len(h.counts) != h.size() {
+		t.Errorf("Expected %d counters, got %d", h.size(), len(h.counts))
+	}
+
+	// The values above the highest are clamped
+	if h.max != 3600 || h.counts[h.index(3600)] != 3 {
+		t.Errorf("Expected 3 values clamped to 3600, got max %v", h.max)
+	}
+
+	if h.counts[0] != 1 || h.min != 0 {
+		t.Errorf("Expected negative value counted as 0, got %v %v", h.counts[0], h.min)
+	}
+}
+
+func TestHDRCollapse(t *testing.T) {
+	h := newHDRHistogram(1, 1e6, 2)
+	for _, v := range []float64{1, 5, 10, 99, 100, 5000} {
+		h.add(v)
+	}
+
+	hist := make([]int64, 3)
+	h.collapse([]float64{10, 100}, hist)
+	if !reflect.DeepEqual(hist, []int64{2, 2, 2}) {
+		t.Errorf("Expected [2 2 2], got %v", hist)
+	}
+
+	h.reset()
+	if h.count != 0 || h.quantile(0.5) != 0 {
+		t.Errorf("Expected empty histogram after reset")
+	}
+}
@@ -0,0 +1,101 @@
+package graphite
+
+import (
+	"math"
+	"math/bits"
+)
+
+// hyperLogLog estimates the number of distinct 64-bit hashes (Flajolet et al., 2007) in 2^precision bytes.
+// The standard error of the estimation is 1.04/sqrt(2^precision), for example 1.6% for precision 12.
+type hyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+func newHyperLogLog(precision uint8) *hyperLogLog {
+	return &hyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}
+}
+
+func (h *hyperLogLog) add(hash uint64) {
+	i := hash >> (64 - h.precision)
+	w := hash<<h.precision | 1<<(h.precision-1)
+	rank := uint8(bits.LeadingZeros64(w) + 1)
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities
+		return m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// merge makes the sketch count the hashes of other too. Both sketches must have the same precision.
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+func (h *hyperLogLog) reset() {
+	for i := range h.registers {
+		h.registers[i] = 0
+	}
+}
+
+// hashUint64 mixes the bits of x (the finalizer of SplitMix64), so that similar members get unrelated hashes.
+func hashUint64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// hashFloat64 hashes a value passed to HandleValue. Whole values that fit in uint64 are hashed as with hashUint64,
+// so HandleValue(name, 42) and SetMetric.AddUint64(42) add the same member.
+func hashFloat64(value float64) uint64 {
+	if value >= 0 && value < 1<<64 && value == math.Trunc(value) {
+		return hashUint64(uint64(value))
+	}
+	return hashUint64(math.Float64bits(value))
+}
+
+// hashString hashes s with FNV-1a and mixes the result with hashUint64.
+func hashString(s string) uint64 {
+	var h uint64 = 14695981039346656037
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return hashUint64(h)
+}
@@ -0,0 +1,62 @@
+package graphite
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 100, 1000, 10000, 100000, 1000000} {
+		h := newHyperLogLog(12)
+		for i := 0; i < n; i++ {
+			h.add(hashString("user" + strconv.Itoa(i)))
+			// Duplicates don't change the estimation
+			h.add(hashString("user" + strconv.Itoa(i)))
+		}
+
+		// 4 standard errors
+		if e := h.estimate(); math.Abs(e-float64(n)) > 4*1.04/64*float64(n) {
+			t.Errorf("Expected %v, got %v", n, e)
+		}
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a := newHyperLogLog(10)
+	b := newHyperLogLog(10)
+	all := newHyperLogLog(10)
+	for i := uint64(0); i < 20000; i++ {
+		if i < 15000 {
+			a.add(hashUint64(i))
+		}
+		if i >= 5000 {
+			b.add(hashUint64(i))
+		}
+		all.add(hashUint64(i))
+	}
+
+	a.merge(b)
+	if a.estimate() != all.estimate() {
+		t.Errorf("Expected %v, got %v", all.estimate(), a.estimate())
+	}
+
+	a.reset()
+	if a.estimate() != 0 {
+		t.Errorf("Expected 0, got %v", a.estimate())
+	}
+}
+
+func TestHashFloat64(t *testing.T) {
+	for _, v := range []uint64{0, 42, 1 << 53, 1 << 63} {
+		if hashFloat64(float64(v)) != hashUint64(v) {
+			t.Errorf("Expected the hash of %v as uint64", v)
+		}
+	}
+
+	for _, v := range []float64{-1, 0.5, 1 << 64, math.NaN(), math.Inf(1)} {
+		if hashFloat64(v) != hashUint64(math.Float64bits(v)) {
+			t.Errorf("Expected the hash of the bits of %v", v)
+		}
+	}
+}
@@ -2,15 +2,77 @@ package graphite
 
 import (
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math/rand"
 	"net"
 	"strconv"
 	"time"
 )
 
+type valueOp int8
+
+const (
+	opValue valueOp = iota
+	opAdd
+	opMember
+	opKey
+)
+
 type graphiteValue struct {
-	name  string
-	value float64
+	name   string
+	value  float64
+	hash   uint64
+	member string
+	op     valueOp
+}
+
+func (gr *Graphite) sendValue(v graphiteValue) error {
+	if gr == nil || gr.metrics == nil {
+		return fmt.Errorf("HandleValue: Call NewGraphite() before HandleValue()")
+	}
+
+	if gr.disabled == true {
+		return nil
+	}
+
+	if gr.started != true {
+		return fmt.Errorf("HandleValue: Call Start() before HandleValue()")
+	}
+
+	mt, ok := gr.metrics[v.name]
+	if !ok {
+		return fmt.Errorf("HandleValue: Metric %s don't exist", v.name)
+	}
+
+	// The policy applies to the new value of a gauge changed by opAdd, which is known in the loop goroutine only
+	if v.op == opValue {
+		value, ok, err := gr.checkValue(mt, v.name, v.value)
+		if ok == false {
+			return err
+		}
+		v.value = value
+	}
+
+	gr.valuesChan <- v
+	return nil
+}
+
+func (gr *Graphite) handleValue(v graphiteValue) {
+	mt := gr.metrics[v.name]
+	switch v.op {
+	case opAdd:
+		mt.handleAdd(v.value, func(value float64) (float64, bool) {
+			value, ok, _ := gr.checkValue(mt, v.name, value)
+			return value, ok
+		})
+	case opMember:
+		mt.handleMember(v.hash)
+	case opKey:
+		mt.handleKey(v.member)
+	default:
+		mt.handleValue(v.value)
+	}
 }
 
 type connection interface {
@@ -60,7 +122,7 @@ func (c *tcpConnection) connect() (err error) {
 	return
 }
 
-func (gr *Graphite) registerMetric(name string, mType metricType, normalizeByInterval bool, histRanges []float64) error {
+func (gr *Graphite) registerMetric(name string, mType metricType, normalizeByInterval bool, histRanges []float64, options ...MetricOption) error {
 	if gr == nil || gr.metrics == nil {
 		return fmt.Errorf("RegisterMetric: Call NewGraphite() before RegisterMetric()")
 	}
@@ -76,58 +138,338 @@ func (gr *Graphite) registerMetric(name string, mType metricType, normalizeByInt
 	v.mType = mType
 	v.normalizeByInterval = normalizeByInterval
 	v.flushInterval = gr.flushInterval
-	v.histRanges = histRanges
-	v.hist = make([]int32, len(v.histRanges)+1)
+	v.histRanges = append([]float64(nil), histRanges...)
+	v.histOutput = HistCounts
+	v.idleZeros = gr.idleZeros
+	v.valuePolicy = gr.valuePolicy
+
+	for _, option := range options {
+		option(&v)
+	}
+
+	if err := checkValuePolicy(v.valuePolicy); err != nil {
+		return fmt.Errorf("RegisterMetric: %v of metric %s", err, name)
+	}
+
+	if v.flushInterval <= 0 || v.flushInterval%gr.flushInterval != 0 {
+		return fmt.Errorf("RegisterMetric: Flush interval (%v) of metric %s isn't a multiple of %v", v.flushInterval, name, gr.flushInterval)
+	}
+	if err := v.init(); err != nil {
+		return fmt.Errorf("RegisterMetric: %v for metric %s", err, name)
+	}
+
+	suffixes := make(map[string]bool)
+	for _, resolution := range v.resolutions {
+		if resolution <= 0 || resolution%gr.flushInterval != 0 {
+			return fmt.Errorf("RegisterMetric: Resolution (%v) of metric %s isn't a multiple of %v", resolution, name, gr.flushInterval)
+		}
+
+		rollup, err := v.rollup(resolution)
+		if err != nil {
+			return fmt.Errorf("RegisterMetric: %v for metric %s", err, name)
+		}
+		if suffixes[rollup.suffix] {
+			return fmt.Errorf("RegisterMetric: Duplicate resolution (%v) of metric %s", resolution, name)
+		}
+		suffixes[rollup.suffix] = true
+		v.rollups = append(v.rollups, rollup)
+	}
+
+	if v.valuePolicy.policy != ValueAccept {
+		gr.validating = true
+	}
 
 	gr.metrics[name] = &v
 	return nil
 }
 
 func (gr *Graphite) fillBuffer(currentTime time.Time) {
-	current_time := strconv.Itoa(int(currentTime.Unix()))
-
 	if gr.buffer.Len() > maxBufSize {
 		log.Printf("Graphite.sendMetrics: buffer size > %d. Reset buffer.", maxBufSize)
 		gr.buffer.Reset()
 	}
 
 	for name, value := range gr.metrics {
-		if gr.metrics[name].mType != metricHist {
-			v, c := value.get()
+		if len(value.rollups) == 0 {
+			gr.flushMetric(name, value, currentTime)
+			continue
+		}
+
+		value.mergeStaged()
+		for _, rollup := range value.rollups {
+			gr.flushMetric(name+"."+rollup.suffix, rollup, currentTime)
+		}
+	}
+
+	gr.writeValueCounts(currentTime)
+}
+
+func (gr *Graphite) flushMetric(name string, value *graphiteMetric, currentTime time.Time) {
+	if stamp, ok := gr.metricDue(value, currentTime); ok {
+		if value.mType == metricMeter {
+			value.updateRates(currentTime)
+		}
+		gr.writeMetric(name, value, strconv.FormatInt(stamp.Unix(), 10))
+	}
+}
 
+// metricDue reports whether the interval of the metric is over at currentTime, and returns the timestamp for its points.
+// In aligned mode the metric has its own window aligned to its flush interval, otherwise it is flushed on every n-th tick.
+func (gr *Graphite) metricDue(mt *graphiteMetric, currentTime time.Time) (time.Time, bool) {
+	if gr.aligned == true {
+		if mt.windowStart.IsZero() {
+			mt.windowStart = alignTime(gr.windowStart, mt.flushInterval)
+		}
+
+		boundary := alignTime(currentTime, mt.flushInterval)
+		if !boundary.After(mt.windowStart) {
+			return time.Time{}, false
+		}
+
+		stamp := mt.windowStart
+		if gr.windowStamp == StampWindowEnd {
+			stamp = stamp.Add(mt.flushInterval)
+		}
+		mt.windowStart = boundary
+		return stamp, true
+	}
+
+	mt.ticks += 1
+	if time.Duration(mt.ticks)*gr.flushInterval < mt.flushInterval {
+		return time.Time{}, false
+	}
+	mt.ticks = 0
+	return currentTime, true
+}
+
+func (gr *Graphite) writeMetric(name string, value *graphiteMetric, current_time string) {
+	switch value.mType {
+	case metricHist:
+		c, sum, min, max := value.getStats()
+		if c > 0 || value.idleZeros == true {
+			gr.writeHist(name, value, current_time)
+			if value.histStats == true {
+				gr.writeLine(name+".count", strconv.FormatInt(c, 10), current_time)
+				gr.writeLine(name+".sum", formatValue(sum), current_time)
+			}
+			if value.histStats == true && c > 0 {
+				gr.writeLine(name+".min", formatValue(min), current_time)
+				gr.writeLine(name+".max", formatValue(max), current_time)
+			}
+			value.reset()
+		}
+	case metricTimer:
+		c, sum, min, max := value.getStats()
+		if c > 0 || value.idleZeros == true {
+			gr.writeLine(name+".count", strconv.FormatInt(c, 10), current_time)
+			gr.writeLine(name+".sum", formatValue(sum), current_time)
 			if c > 0 {
-				value.reset()
-				gr.buffer.WriteString(gr.prefix)
-				gr.buffer.WriteString(name)
-				gr.buffer.WriteString(" ")
-				gr.buffer.WriteString(strconv.FormatFloat(v, 'f', 12, 64))
-				gr.buffer.WriteString(" ")
-				gr.buffer.WriteString(current_time)
-				gr.buffer.WriteString("\n")
-			}
-		} else {
-			hist, c := value.getHist()
+				gr.writeLine(name+".mean", formatValue(sum/float64(c)), current_time)
+				gr.writeLine(name+".min", formatValue(min), current_time)
+				gr.writeLine(name+".max", formatValue(max), current_time)
+			}
+			if len(value.histRanges) > 0 {
+				gr.writeHist(name+".hist", value, current_time)
+			}
+			value.reset()
+		}
+	case metricSummary:
+		c, sum, min, max := value.getStats()
+		if c > 0 || value.idleZeros == true {
+			if value.aggregations&SummaryCount != 0 {
+				gr.writeLine(name+".count", strconv.FormatInt(c, 10), current_time)
+			}
+			if value.aggregations&SummarySum != 0 {
+				gr.writeLine(name+".sum", formatValue(sum), current_time)
+			}
+			if value.aggregations&SummaryAvg != 0 && c > 0 {
+				gr.writeLine(name+".avg", formatValue(sum/float64(c)), current_time)
+			}
+			if value.aggregations&SummaryMin != 0 && c > 0 {
+				gr.writeLine(name+".min", formatValue(min), current_time)
+			}
+			if value.aggregations&SummaryMax != 0 && c > 0 {
+				gr.writeLine(name+".max", formatValue(max), current_time)
+			}
+			if value.aggregations&SummaryLast != 0 && c > 0 {
+				gr.writeLine(name+".last", formatValue(value.value), current_time)
+			}
+			if value.aggregations&SummaryHist != 0 {
+				gr.writeHist(name+".hist", value, current_time)
+			}
+			value.reset()
+		}
+	case metricHDR:
+		values, c := value.getQuantiles()
+		if c > 0 || value.idleZeros == true {
+			gr.writeLine(name+".count", strconv.FormatInt(c, 10), current_time)
 			if c > 0 {
-				for i, v := range hist {
-					gr.buffer.WriteString(gr.prefix)
-					gr.buffer.WriteString(name)
-					gr.buffer.WriteString(".")
-					gr.buffer.WriteString(strconv.Itoa(i))
-					gr.buffer.WriteString(" ")
-					gr.buffer.WriteString(strconv.Itoa(int(v)))
-					gr.buffer.WriteString(" ")
-					gr.buffer.WriteString(current_time)
-					gr.buffer.WriteString("\n")
+				for i, v := range values {
+					gr.writeLine(name+"."+quantileName(value.quantiles[i]), formatValue(v), current_time)
 				}
-				value.reset()
 			}
+			if len(value.histRanges) > 0 {
+				value.collapseHDR()
+				gr.writeHist(name, value, current_time)
+			}
+			value.reset()
+		}
+	case metricPersistentGauge:
+		if value.isFresh() {
+			gr.writeLine(name, formatValue(value.value), current_time)
+		}
+		value.reset()
+	case metricMeter:
+		gr.writeLine(name+".count", formatValue(value.total()), current_time)
+		gr.writeLine(name+".m1_rate", formatValue(value.rates[0]), current_time)
+		gr.writeLine(name+".m5_rate", formatValue(value.rates[1]), current_time)
+		gr.writeLine(name+".m15_rate", formatValue(value.rates[2]), current_time)
+		value.reset()
+	case metricStats:
+		if value.counter > 0 {
+			gr.writeLine(name+".count", strconv.FormatInt(value.counter, 10), current_time)
+			gr.writeLine(name+".mean", formatValue(value.stats.mean), current_time)
+			gr.writeLine(name+".stddev", formatValue(value.stats.stddev()), current_time)
+			gr.writeLine(name+".variance", formatValue(value.stats.variance()), current_time)
+			gr.writeLine(name+".min", formatValue(value.stats.min), current_time)
+			gr.writeLine(name+".max", formatValue(value.stats.max), current_time)
+			value.reset()
+		}
+	case metricSet:
+		v, c := value.get()
+		if c > 0 || value.idleZeros == true {
+			gr.writeLine(name, strconv.FormatFloat(v, 'f', 0, 64), current_time)
+			value.reset()
+		}
+	case metricApdex:
+		if value.counter > 0 || value.idleZeros == true {
+			if value.counter > 0 {
+				gr.writeLine(name+".score", formatValue(value.apdexScore()), current_time)
+			}
+			gr.writeLine(name+".satisfied", strconv.FormatInt(value.apdex[0], 10), current_time)
+			gr.writeLine(name+".tolerating", strconv.FormatInt(value.apdex[1], 10), current_time)
+			gr.writeLine(name+".frustrated", strconv.FormatInt(value.apdex[2], 10), current_time)
+			value.reset()
+		}
+	case metricRatio:
+		if value.counter > 0 || value.idleZeros == true {
+			if value.counter > 0 {
+				gr.writeLine(name+".ratio", formatValue(value.value/float64(value.counter)), current_time)
+			}
+			gr.writeLine(name+".numerator", strconv.FormatFloat(value.value, 'f', 0, 64), current_time)
+			gr.writeLine(name+".denominator", strconv.FormatInt(value.counter, 10), current_time)
+			value.reset()
+		}
+	case metricCustom:
+		if value.counter > 0 || value.idleZeros == true {
+			gr.writeSnapshot(name, value, current_time)
+			value.reset()
 		}
+	case metricTopK:
+		if value.counter > 0 {
+			for _, e := range value.topKeys.top(value.topK) {
+				gr.writeLine(name+"."+e.key, strconv.FormatInt(e.count, 10), current_time)
+			}
+			value.reset()
+		}
+	case metricQuantile:
+		values, c := value.getQuantiles()
+		if c > 0 {
+			for i, v := range values {
+				gr.writeLine(name+"."+quantileName(value.quantiles[i]), formatValue(v), current_time)
+			}
+			value.reset()
+		}
+	default:
+		v, c := value.get()
+		if c > 0 || (value.idleZeros == true && (value.mType == metricCounter || value.mType == metricDerive)) {
+			value.reset()
+			gr.writeLine(name, formatValue(v), current_time)
+		}
+	}
+}
+
+func (gr *Graphite) writeHist(name string, value *graphiteMetric, current_time string) {
+	hist, c := value.getHist()
+	var total int64
+	for i, v := range hist {
+		total += v
+		if value.histNaming == HistCumulative {
+			v = total
+		}
+
+		bucket := histBucketName(value.histRanges, i, value.histNaming)
+		if value.histOutput&HistCounts != 0 {
+			gr.writeLine(name+"."+bucket, strconv.FormatInt(v, 10), current_time)
+		}
+		// The percentages of an idle interval are undefined
+		if value.histOutput&HistPercent != 0 && c > 0 {
+			gr.writeLine(name+".pct."+bucket, formatValue(percent(v, c)), current_time)
+		}
+		if value.histOutput&HistCumulativePercent != 0 && c > 0 {
+			bucket = histBucketName(value.histRanges, i, HistCumulative)
+			gr.writeLine(name+".pct_lt."+bucket, formatValue(percent(total, c)), current_time)
+		}
+	}
+}
+
+func percent(n int64, total int64) float64 {
+	if total == 0 {
+		return 0
 	}
+	return 100 * float64(n) / float64(total)
 }
 
+func (gr *Graphite) writeLine(name string, value string, current_time string) {
+	gr.buffer.WriteString(gr.prefix)
+	gr.buffer.WriteString(name)
+	gr.buffer.WriteString(" ")
+	gr.buffer.WriteString(value)
+	gr.buffer.WriteString(" ")
+	gr.buffer.WriteString(current_time)
+	gr.buffer.WriteString("\n")
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', 12, 64)
+}
+
+// sendMetrics collects the values of the collectors, closes the aggregation interval and sends the metrics to the server. With a send jitter the buffer is sent later by the send timer.
 func (gr *Graphite) sendMetrics(currentTime time.Time) {
+	gr.collect()
 	gr.fillBuffer(currentTime)
+	gr.sendBuffer()
+}
 
+func (gr *Graphite) sendBuffer() {
+	if gr.sendJitter == 0 {
+		gr.writeBuffer()
+		return
+	}
+
+	// If the previous send is still pending, it sends this interval too
+	if gr.sendTimer == nil && gr.buffer.Len() > 0 {
+		gr.sendTimer = gr.clock.NewTimer(gr.sendDelay())
+		gr.sendChan = gr.sendTimer.C()
+	}
+}
+
+func (gr *Graphite) sendDelay() time.Duration {
+	if gr.jitterMode == JitterHostname {
+		return gr.hostDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(gr.sendJitter)))
+}
+
+// hostnameDelay derives a constant send delay in [0, maxDelay) from the hash of the hostname.
+func hostnameDelay(hostname string, maxDelay time.Duration) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(hostname))
+	return time.Duration(h.Sum64() % uint64(maxDelay))
+}
+
+func (gr *Graphite) writeBuffer() {
 	if gr.buffer.Len() > 0 {
 		_, err := gr.conn.Write(gr.buffer.Bytes())
 		if err != nil {
@@ -142,13 +484,71 @@ func (gr *Graphite) handleChans() {
 	for {
 		select {
 		case t := <-gr.tickerChan:
-			gr.sendMetrics(t)
+			gr.handlePendingValues()
+			if gr.aligned == true {
+				gr.closeWindow(t)
+			} else {
+				gr.sendMetrics(t)
+			}
+
+		case <-gr.sendChan:
+			gr.sendTimer = nil
+			gr.sendChan = nil
+			gr.writeBuffer()
 
 		case v := <-gr.valuesChan:
-			gr.metrics[v.name].handleValue(v.value)
+			gr.handleValue(v)
 
 		case _, _ = <-gr.stopChan:
+			if gr.timer != nil {
+				gr.timer.Stop()
+			}
+			if gr.sendTimer != nil {
+				gr.sendTimer.Stop()
+			}
 			return
 		}
 	}
 }
+
+// handlePendingValues processes the values queued before the tick, so they are counted in the interval being flushed.
+func (gr *Graphite) handlePendingValues() {
+	for i := len(gr.valuesChan); i > 0; i-- {
+		gr.handleValue(<-gr.valuesChan)
+	}
+}
+
+// alignTime rounds t down to a multiple of interval since the epoch.
+func alignTime(t time.Time, interval time.Duration) time.Time {
+	ns := t.UnixNano()
+	return time.Unix(0, ns-ns%int64(interval)).In(t.Location())
+}
+
+// scheduleFlush sets a timer for the end of the current aggregation window.
+func (gr *Graphite) scheduleFlush(now time.Time) {
+	gr.timer = gr.clock.NewTimer(gr.windowStart.Add(gr.flushInterval).Sub(now))
+	gr.tickerChan = gr.timer.C()
+}
+
+// closeWindow sends the metrics of the current aggregation window in aligned mode.
+// A tick that comes before the end of the window (for example, due to a clock adjustment) doesn't flush anything.
+// A late tick, for example after a long GC pause, closes every window that has ended by now. Each of them is flushed with its
+// own timestamp: the accumulated values go to the first one and the skipped windows are empty (or idle zeros),
+// so the data of several intervals is never sent as one bucket.
+func (gr *Graphite) closeWindow(t time.Time) {
+	if now := gr.clock.Now(); now.After(t) {
+		t = now
+	}
+	boundary := alignTime(t, gr.flushInterval)
+	if boundary.After(gr.windowStart) {
+		gr.collect()
+		for gr.windowStart.Before(boundary) {
+			end := gr.windowStart.Add(gr.flushInterval)
+			gr.fillBuffer(end)
+			gr.windowStart = end
+		}
+		gr.sendBuffer()
+	}
+
+	gr.scheduleFlush(gr.clock.Now())
+}
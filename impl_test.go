@@ -3,10 +3,12 @@ package graphite
 import (
 	"bytes"
 	"log"
+	"math"
 	"os"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -19,6 +21,21 @@ prefix.minimum 1.000000000000 946782245
 prefix.gauge 8.000000000000 946782245
 `
 
+// sortedLines splits the output into lines and sorts them, since metrics are flushed in the order of map iteration.
+func sortedLines(output string) []string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+// assertLines checks that the output has the expected lines in any order.
+func assertLines(t *testing.T, output string, expected []string) {
+	t.Helper()
+	if lines := sortedLines(output); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, lines)
+	}
+}
+
 func TestRegisterMetric(t *testing.T) {
 	var graph *Graphite = nil
 	err := graph.registerMetric("average", metricAverage, true, []float64{1, 2, 3})
@@ -52,7 +69,7 @@ func TestRegisterMetric(t *testing.T) {
 		t.Errorf("Expected [1 2 3], got %v", metric.histRanges)
 	}
 
-	equal = reflect.DeepEqual(metric.hist, []int32{0, 0, 0, 0})
+	equal = reflect.DeepEqual(metric.hist, []int64{0, 0, 0, 0})
 	if equal != true {
 		t.Errorf("Expected [0 0 0 0], got %v", metric.hist)
 	}
@@ -126,6 +143,7 @@ func TestBufferExceed(t *testing.T) {
 }
 
 type testConnection struct {
+	mu     sync.Mutex
 	Buffer bytes.Buffer
 }
 
@@ -134,9 +152,25 @@ func (c *testConnection) Close() error {
 }
 
 func (c *testConnection) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.Buffer.Write(p)
 }
 
+// waitOutput waits until something is sent to the connection and returns the sent text.
+func (c *testConnection) waitOutput() string {
+	for i := 0; i < 200; i++ {
+		c.mu.Lock()
+		output := c.Buffer.String()
+		c.mu.Unlock()
+		if len(output) > 0 {
+			return output
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return ""
+}
+
 func (c *testConnection) connect() error {
 	return nil
 }
@@ -158,6 +192,533 @@ func TestSendMetrics(t *testing.T) {
 	graph.Stop()
 }
 
+func TestSendMetricsFakeClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock))
+	graph.RegisterCounter("counter", false)
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+	graph.HandleValue("counter", 1)
+	graph.HandleValue("counter", 2)
+	clock.Advance(10 * time.Second)
+
+	expected := "prefix.counter 3.000000000000 946782255\n"
+	if output := c.waitOutput(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+	graph.Stop()
+}
+
+func TestAlignTime(t *testing.T) {
+	tm := time.Date(2000, 1, 2, 3, 4, 5, 300, time.UTC)
+
+	if aligned := alignTime(tm, 10*time.Second); !aligned.Equal(time.Date(2000, 1, 2, 3, 4, 0, 0, time.UTC)) {
+		t.Errorf("Expected 03:04:00, got %v", aligned)
+	}
+
+	// 7s intervals are counted from the epoch, not from the zero time
+	if aligned := alignTime(tm, 7*time.Second); aligned.Unix()%7 != 0 || tm.Sub(aligned) >= 7*time.Second {
+		t.Errorf("Got wrong aligned time %v", aligned)
+	}
+}
+
+func TestAlignedFlush(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 5, int(300*time.Millisecond), time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock), WithAlignedFlush(StampWindowStart))
+	graph.RegisterCounter("counter", false)
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+	graph.HandleValue("counter", 1)
+	clock.Advance(4700 * time.Millisecond)
+
+	// The window 03:04:00 - 03:04:10 is stamped with its start
+	expected := "prefix.counter 1.000000000000 946782240\n"
+	if output := c.waitOutput(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+	graph.Stop()
+}
+
+func TestCloseWindow(t *testing.T) {
+	start := time.Date(2000, 1, 2, 3, 4, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock), WithAlignedFlush(StampWindowEnd))
+	graph.RegisterCounter("counter", false)
+	c := new(testConnection)
+	graph.conn = c
+	graph.windowStart = start
+
+	// Early tick doesn't close the window
+	graph.metrics["counter"].handleValue(1)
+	graph.closeWindow(start.Add(9 * time.Second))
+	if c.Buffer.Len() != 0 {
+		t.Errorf("Unexpected output \"%v\" for early tick", c.Buffer.String())
+	}
+
+	// Late tick closes every ended window, and the values go to the first one
+	graph.closeWindow(start.Add(35 * time.Second))
+	expected := "prefix.counter 1.000000000000 946782250\n"
+	if output := c.Buffer.String(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+
+	if !graph.windowStart.Equal(start.Add(30 * time.Second)) {
+		t.Errorf("Expected next window at %v, got %v", start.Add(30*time.Second), graph.windowStart)
+	}
+
+	// Next tick stamps the following window, not the same bucket
+	c.Buffer.Reset()
+	graph.metrics["counter"].handleValue(2)
+	graph.closeWindow(start.Add(40 * time.Second))
+	expected = "prefix.counter 2.000000000000 946782280\n"
+	if output := c.Buffer.String(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+}
+
+func TestLateTickSkippedWindows(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 0, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock), WithAlignedFlush(StampWindowStart), WithIdleZeros())
+	graph.RegisterCounter("counter", false)
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+	defer graph.Stop()
+
+	// The tick of 03:04:10 is handled at 03:04:35, so three windows are closed at once, each with its own timestamp
+	graph.HandleValue("counter", 1)
+	clock.Advance(35 * time.Second)
+	assertLines(t, c.waitOutput(), []string{
+		"prefix.counter 0.000000000000 946782250",
+		"prefix.counter 0.000000000000 946782260",
+		"prefix.counter 1.000000000000 946782240",
+	})
+
+	// The values after the late tick go to the window they were sent in
+	c.mu.Lock()
+	c.Buffer.Reset()
+	c.mu.Unlock()
+	graph.HandleValue("counter", 2)
+	clock.Advance(5 * time.Second)
+	assertLines(t, c.waitOutput(), []string{"prefix.counter 2.000000000000 946782270"})
+}
+
+func TestSendJitter(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 0, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock), WithAlignedFlush(StampWindowStart), WithSendJitter(5*time.Second, JitterRandom))
+	graph.RegisterCounter("counter", false)
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+	graph.HandleValue("counter", 1)
+	clock.Advance(10 * time.Second)
+
+	// The interval is closed on schedule, but nothing is sent until the send timer fires
+	time.Sleep(20 * time.Millisecond)
+	c.mu.Lock()
+	if c.Buffer.Len() != 0 {
+		t.Errorf("Unexpected output \"%v\" before the send delay", c.Buffer.String())
+	}
+	c.mu.Unlock()
+
+	clock.Advance(5 * time.Second)
+	expected := "prefix.counter 1.000000000000 946782240\n"
+	if output := c.waitOutput(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+	graph.Stop()
+}
+
+func TestSendDelay(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithSendJitter(5*time.Second, JitterHostname))
+
+	d := graph.sendDelay()
+	if d < 0 || d >= 5*time.Second {
+		t.Errorf("Expected delay in [0, 5s), got %v", d)
+	}
+
+	hostname, _ := os.Hostname()
+	if graph.sendDelay() != d || d != hostnameDelay(hostname, 5*time.Second) {
+		t.Error("Expected the same delay for the same hostname")
+	}
+
+	if hostnameDelay("host1", 5*time.Second) == hostnameDelay("host2", 5*time.Second) {
+		t.Error("Expected different delays for different hostnames")
+	}
+
+	graph, _ = NewGraphite("", 0, "prefix", 10*time.Second, false, WithSendJitter(5*time.Second, JitterRandom))
+	for i := 0; i < 100; i++ {
+		if d = graph.sendDelay(); d < 0 || d >= 5*time.Second {
+			t.Errorf("Expected delay in [0, 5s), got %v", d)
+		}
+	}
+}
+
+func TestMetricInterval(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false)
+	graph.RegisterCounter("fast", false)
+	graph.RegisterCounter("slow", true, MetricInterval(30*time.Second))
+	tm := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		graph.metrics["fast"].handleValue(1)
+		graph.metrics["slow"].handleValue(30)
+		graph.fillBuffer(tm)
+	}
+
+	expected := []string{
+		"prefix.fast 1.000000000000 946782245",
+		"prefix.fast 1.000000000000 946782245",
+		"prefix.fast 1.000000000000 946782245",
+		"prefix.slow 3.000000000000 946782245",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+}
+
+func TestMetricIntervalAligned(t *testing.T) {
+	start := time.Date(2000, 1, 2, 3, 4, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock), WithAlignedFlush(StampWindowStart))
+	graph.RegisterCounter("slow", false, MetricInterval(time.Minute))
+	c := new(testConnection)
+	graph.conn = c
+	graph.windowStart = start
+
+	// The minute window 03:04 - 03:05 is closed by the tick at 03:05:00
+	for i := 1; i <= 6; i++ {
+		graph.metrics["slow"].handleValue(1)
+		graph.closeWindow(start.Add(time.Duration(i) * 10 * time.Second))
+		if i < 6 && c.Buffer.Len() != 0 {
+			t.Errorf("Unexpected output \"%v\" at tick %d", c.Buffer.String(), i)
+		}
+	}
+
+	expected := "prefix.slow 6.000000000000 946782240\n"
+	if output := c.Buffer.String(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+}
+
+func TestMetricResolutions(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false)
+	err := graph.RegisterCounter("counter", false, MetricResolutions(10*time.Second, 20*time.Second))
+	if err != nil {
+		t.Errorf("RegisterCounter() got error(%v)", err)
+	}
+
+	tm := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 1; i <= 2; i++ {
+		graph.metrics["counter"].handleValue(float64(i))
+		graph.fillBuffer(tm)
+	}
+
+	expected := "prefix.counter.10s 1.000000000000 946782245\n" +
+		"prefix.counter.10s 2.000000000000 946782245\n" +
+		"prefix.counter.20s 3.000000000000 946782245\n"
+	if output := graph.buffer.String(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+
+	err = graph.RegisterCounter("counter2", false, MetricResolutions(10*time.Second, 15*time.Second))
+	if err == nil {
+		t.Error("Expected error for resolution, which isn't a multiple of 10s")
+	}
+
+	err = graph.RegisterCounter("counter3", false, MetricResolutions(60*time.Second, time.Minute))
+	if err == nil {
+		t.Error("Expected error for duplicate resolution")
+	}
+}
+
+func TestMetricResolutionsMerged(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false)
+	resolutions := MetricResolutions(10*time.Second, 30*time.Second)
+	graph.RegisterStats("stats", resolutions)
+	graph.RegisterQuantile("quantile", []float64{0, 1}, 0.01, resolutions)
+	graph.RegisterSet("set", 12, resolutions)
+	for _, name := range []string{"stats", "quantile", "set"} {
+		if graph.metrics[name].staged == false {
+			t.Errorf("Expected staged %v", name)
+		}
+	}
+
+	tm := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i, values := range [][]float64{{2, 4}, {4, 4, 5}, {5, 7, 9}} {
+		for _, v := range values {
+			graph.handleValue(graphiteValue{name: "stats", value: v})
+			graph.handleValue(graphiteValue{name: "quantile", value: v})
+			graph.handleValue(graphiteValue{name: "set", hash: hashUint64(uint64(v)), op: opMember})
+		}
+		graph.buffer.Reset()
+		graph.fillBuffer(tm.Add(time.Duration(i) * 10 * time.Second))
+	}
+
+	// The last 10s interval and the 30s interval with all values
+	expected := []string{
+		"prefix.quantile.10s.p0 5.000000000000 946782265",
+		"prefix.quantile.10s.p100 9.000000000000 946782265",
+		"prefix.quantile.30s.p0 2.000000000000 946782265",
+		"prefix.quantile.30s.p100 9.000000000000 946782265",
+		"prefix.set.10s 3 946782265",
+		"prefix.set.30s 5 946782265",
+		"prefix.stats.10s.count 3 946782265",
+		"prefix.stats.10s.max 9.000000000000 946782265",
+		"prefix.stats.10s.mean 7.000000000000 946782265",
+		"prefix.stats.10s.min 5.000000000000 946782265",
+		"prefix.stats.10s.stddev 1.632993161855 946782265",
+		"prefix.stats.10s.variance 2.666666666667 946782265",
+		"prefix.stats.30s.count 8 946782265",
+		"prefix.stats.30s.max 9.000000000000 946782265",
+		"prefix.stats.30s.mean 5.000000000000 946782265",
+		"prefix.stats.30s.min 2.000000000000 946782265",
+		"prefix.stats.30s.stddev 2.000000000000 946782265",
+		"prefix.stats.30s.variance 4.000000000000 946782265",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+}
+
+func TestFillBufferQuantile(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterQuantile("latency", []float64{0.5, 0.999}, 0.01)
+	for i := 1; i <= 1000; i++ {
+		graph.metrics["latency"].handleValue(float64(i))
+	}
+
+	graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+	lines := sortedLines(graph.buffer.String())
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "prefix.latency.p50 ") || !strings.HasPrefix(lines[1], "prefix.latency.p999 ") {
+		t.Errorf("Got unexpected output \"%v\"", graph.buffer.String())
+	}
+
+	// Empty interval sends nothing
+	graph.buffer.Reset()
+	graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 7, 0, time.UTC))
+	if graph.buffer.Len() != 0 {
+		t.Errorf("Got unexpected output \"%v\"", graph.buffer.String())
+	}
+}
+
+func TestFillBufferHistNaming(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterHist("bounds", []float64{10, 25}, MetricHistNaming(HistNameBounds))
+	graph.RegisterHist("le", []float64{10, 25}, MetricHistNaming(HistCumulative), MetricHistStats())
+	for _, v := range []float64{5, 12, 30, 40} {
+		graph.metrics["bounds"].handleValue(v)
+		graph.metrics["le"].handleValue(v)
+	}
+
+	graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	expected := []string{
+		"prefix.bounds.10_25 1 946782245",
+		"prefix.bounds.ge_25 2 946782245",
+		"prefix.bounds.lt_10 1 946782245",
+		"prefix.le.count 4 946782245",
+		"prefix.le.lt_10 1 946782245",
+		"prefix.le.lt_25 2 946782245",
+		"prefix.le.lt_inf 4 946782245",
+		"prefix.le.max 40.000000000000 946782245",
+		"prefix.le.min 5.000000000000 946782245",
+		"prefix.le.sum 87.000000000000 946782245",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+}
+
+func TestFillBufferHistPercent(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterHist("hist", []float64{10, 25}, MetricHistNaming(HistNameBounds), MetricHistOutput(HistPercent|HistCumulativePercent))
+	for _, v := range []float64{5, 12, 30, 40} {
+		graph.metrics["hist"].handleValue(v)
+	}
+
+	graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	expected := []string{
+		"prefix.hist.pct.10_25 25.000000000000 946782245",
+		"prefix.hist.pct.ge_25 50.000000000000 946782245",
+		"prefix.hist.pct.lt_10 25.000000000000 946782245",
+		"prefix.hist.pct_lt.lt_10 25.000000000000 946782245",
+		"prefix.hist.pct_lt.lt_25 50.000000000000 946782245",
+		"prefix.hist.pct_lt.lt_inf 100.000000000000 946782245",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+}
+
+func TestFillBufferHDR(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterHDRHist("hdr", 1, 1e6, 2, []float64{0.5}, []float64{10, 100}, MetricHistNaming(HistNameBounds))
+	for _, v := range []float64{1, 5, 20, 30, 40, 5000} {
+		graph.metrics["hdr"].handleValue(v)
+	}
+
+	graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	expected := []string{
+		"prefix.hdr.10_100 3 946782245",
+		"prefix.hdr.count 6 946782245",
+		"prefix.hdr.ge_100 1 946782245",
+		"prefix.hdr.lt_10 2 946782245",
+		"prefix.hdr.p50 20.500000000000 946782245",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+}
+
+func TestIdleZeros(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false, WithIdleZeros())
+	graph.RegisterCounter("counter", true)
+	graph.RegisterCounter("skipped", false, MetricIdleZeros(false))
+	graph.RegisterAverage("average")
+	graph.RegisterHist("hist", []float64{10}, MetricHistStats(), MetricHistOutput(HistCounts|HistPercent))
+	graph.RegisterTimer("timer", time.Millisecond, []float64{10})
+
+	graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	expected := []string{
+		"prefix.counter 0.000000000000 946782245",
+		"prefix.hist.0 0 946782245",
+		"prefix.hist.1 0 946782245",
+		"prefix.hist.count 0 946782245",
+		"prefix.hist.sum 0.000000000000 946782245",
+		"prefix.timer.count 0 946782245",
+		"prefix.timer.hist.0 0 946782245",
+		"prefix.timer.hist.1 0 946782245",
+		"prefix.timer.sum 0.000000000000 946782245",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+}
+
+func TestFillBufferMeter(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterMeter("requests")
+	graph.metrics["requests"].handleValue(3)
+	graph.metrics["requests"].handleValue(1)
+
+	graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	expected := []string{
+		"prefix.requests.count 4.000000000000 946782245",
+		"prefix.requests.m15_rate 2.000000000000 946782245",
+		"prefix.requests.m1_rate 2.000000000000 946782245",
+		"prefix.requests.m5_rate 2.000000000000 946782245",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+}
+
+func TestFillBufferStats(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterStats("latency")
+	for _, v := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		graph.metrics["latency"].handleValue(v)
+	}
+
+	graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	expected := []string{
+		"prefix.latency.count 8 946782245",
+		"prefix.latency.max 9.000000000000 946782245",
+		"prefix.latency.mean 5.000000000000 946782245",
+		"prefix.latency.min 2.000000000000 946782245",
+		"prefix.latency.stddev 2.000000000000 946782245",
+		"prefix.latency.variance 4.000000000000 946782245",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+}
+
+func TestFillBufferSummary(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterSummary("all", SummaryCount|SummarySum|SummaryAvg|SummaryMin|SummaryMax|SummaryLast|SummaryHist, []float64{5})
+	graph.RegisterSummary("minmax", SummaryMin|SummaryMax, nil)
+	graph.RegisterSummary("idle", SummaryCount|SummaryAvg, nil, MetricIdleZeros(true))
+	for _, v := range []float64{4, 8, 1, 3} {
+		graph.metrics["all"].handleValue(v)
+		graph.metrics["minmax"].handleValue(v)
+	}
+
+	graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	expected := []string{
+		"prefix.all.avg 4.000000000000 946782245",
+		"prefix.all.count 4 946782245",
+		"prefix.all.hist.0 3 946782245",
+		"prefix.all.hist.1 1 946782245",
+		"prefix.all.last 3.000000000000 946782245",
+		"prefix.all.max 8.000000000000 946782245",
+		"prefix.all.min 1.000000000000 946782245",
+		"prefix.all.sum 16.000000000000 946782245",
+		"prefix.idle.count 0 946782245",
+		"prefix.minmax.max 8.000000000000 946782245",
+		"prefix.minmax.min 1.000000000000 946782245",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+}
+
+func TestFillBufferApdex(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterApdex("apdex", 100)
+	graph.RegisterApdex("idle", 100, MetricIdleZeros(true))
+	for _, v := range []float64{10, 100, 100.5, 400, 401, 50, 1000, math.NaN()} {
+		graph.metrics["apdex"].handleValue(v)
+	}
+
+	graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	// 3 satisfied, 2 tolerating, 3 frustrated; the score of an idle interval is skipped
+	expected := []string{
+		"prefix.apdex.frustrated 3 946782245",
+		"prefix.apdex.satisfied 3 946782245",
+		"prefix.apdex.score 0.500000000000 946782245",
+		"prefix.apdex.tolerating 2 946782245",
+		"prefix.idle.frustrated 0 946782245",
+		"prefix.idle.satisfied 0 946782245",
+		"prefix.idle.tolerating 0 946782245",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+}
+
+func TestFillBufferRatio(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterRatio("ratio")
+	graph.RegisterRatio("idle", MetricIdleZeros(true))
+	graph.RegisterRatio("skipped")
+	for _, v := range []float64{1, 0, 0, 2, 1} {
+		graph.metrics["ratio"].handleValue(v)
+	}
+
+	graph.fillBuffer(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	// The ratio of an idle interval is skipped
+	expected := []string{
+		"prefix.idle.denominator 0 946782245",
+		"prefix.idle.numerator 0 946782245",
+		"prefix.ratio.denominator 5 946782245",
+		"prefix.ratio.numerator 3 946782245",
+		"prefix.ratio.ratio 0.600000000000 946782245",
+	}
+	assertLines(t, graph.buffer.String(), expected)
+}
+
+func TestFillBufferSet(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 2*time.Second, false)
+	graph.RegisterSet("users", 12)
+	for _, member := range []string{"alice", "bob", "alice", "carol", "bob"} {
+		graph.handleValue(graphiteValue{name: "users", hash: hashString(member), op: opMember})
+	}
+	graph.handleValue(graphiteValue{name: "users", hash: hashUint64(42), op: opMember})
+	graph.handleValue(graphiteValue{name: "users", value: 42, op: opValue})
+
+	tm := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	graph.fillBuffer(tm)
+	graph.fillBuffer(tm)
+
+	// 42 is the same member through AddUint64 and HandleValue; the set is empty after the flush
+	expected := "prefix.users 4 946782245\n"
+	if output := graph.buffer.String(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+}
+
 func BenchmarkFillBuffer(b *testing.B) {
 	graph, _ := NewGraphite("", 0, "prefix", 20*time.Second, false)
 
@@ -1,23 +1,215 @@
 package graphite
 
-import "time"
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type graphiteMetric struct {
 	mType               metricType
 	value               float64
-	counter             int32
+	counter             int64
 	normalizeByInterval bool
 	flushInterval       time.Duration
 	histRanges          []float64
-	hist                []int32
+	hist                []int64
+	histNaming          HistNaming
+	histOutput          HistOutput
+	histStats           bool
+	idleZeros           bool
+	valuePolicy         valuePolicy
+
+	// Compensations of the lost low-order bits of the sums in value and sum (see neumaierAdd)
+	valueCompensation float64
+	sumCompensation   float64
+
+	// Statistics of the values of a timer or a histogram
+	sum float64
+	min float64
+	max float64
+
+	// Quantile sketch
+	quantiles        []float64
+	relativeAccuracy float64
+	sketch           *ddSketch
+
+	// Persistent gauge
+	ttl      time.Duration
+	idle     time.Duration
+	hasValue bool
+
+	// Cumulative counter
+	previous    float64
+	hasPrevious bool
+	wrapAt      float64
+
+	// Statistics with Welford's algorithm
+	stats welford
+
+	// Unique members
+	setPrecision uint8
+	set          *hyperLogLog
+
+	// Aggregations of a summary
+	aggregations SummaryAggregation
+
+	// Satisfied, tolerating and frustrated counts of Apdex
+	apdexThreshold float64
+	apdex          [3]int64
+
+	// Most frequent keys
+	topK         int
+	topKCapacity int
+	topKeys      *spaceSaving
+
+	// User-defined aggregation
+	aggregatorFactory func() Aggregator
+	aggregator        Aggregator
+
+	// A staged metric with resolutions observes the values itself and is merged into the resolutions at each flush (see mergeStaged)
+	staged bool
+
+	// Moving average rates of a meter
+	rates     [3]float64
+	lastFlush time.Time
+
+	// Log-linear histogram
+	hdrLowest  float64
+	hdrHighest float64
+	hdrDigits  int
+	hdr        *hdrHistogram
+
+	// Flush schedule of the metric, see Graphite.metricDue
+	ticks       int
+	windowStart time.Time
+
+	// Independent aggregations of the same values with other flush intervals, see MetricResolutions
+	resolutions []time.Duration
+	rollups     []*graphiteMetric
+	suffix      string
+}
+
+// init allocates the aggregation state of the metric according to its settings.
+func (mt *graphiteMetric) init() error {
+	mt.hist = make([]int64, len(mt.histRanges)+1)
+	switch mt.mType {
+	case metricQuantile:
+		mt.sketch = newDDSketch(mt.relativeAccuracy)
+	case metricHDR:
+		mt.hdr = newHDRHistogram(mt.hdrLowest, mt.hdrHighest, mt.hdrDigits)
+	case metricSet:
+		mt.set = newHyperLogLog(mt.setPrecision)
+	case metricTopK:
+		mt.topKeys = newSpaceSaving(mt.topKCapacity)
+	case metricCustom:
+		if mt.aggregator = mt.aggregatorFactory(); mt.aggregator == nil {
+			return fmt.Errorf("Factory doesn't create an Aggregator")
+		}
+	}
+	mt.staged = len(mt.resolutions) > 0 && mt.mergeable()
+	return nil
+}
+
+// mergeable reports whether the state of the metric can be merged into another one with merge.
+func (mt *graphiteMetric) mergeable() bool {
+	switch mt.mType {
+	case metricStats, metricQuantile, metricSet:
+		return true
+	case metricCustom:
+		_, ok := mt.aggregator.(Merger)
+		return ok
+	}
+	return false
+}
+
+// merge adds the state of other, a metric of the same type and parameters, to the metric.
+func (mt *graphiteMetric) merge(other *graphiteMetric) error {
+	switch mt.mType {
+	case metricStats:
+		mt.stats.merge(other.stats)
+	case metricQuantile:
+		if err := mt.sketch.merge(other.sketch); err != nil {
+			return err
+		}
+	case metricSet:
+		mt.set.merge(other.set)
+	case metricCustom:
+		merger, ok := mt.aggregator.(Merger)
+		if !ok {
+			return fmt.Errorf("Aggregator %T isn't a Merger", mt.aggregator)
+		}
+		if err := merger.Merge(other.aggregator); err != nil {
+			return fmt.Errorf("Aggregator %T merge error: %v", other.aggregator, err)
+		}
+	}
+
+	mt.counter += other.counter
+	return nil
+}
+
+// mergeStaged merges the values observed by a staged metric since the previous flush into its resolutions.
+// Each value is then processed once instead of once per resolution.
+func (mt *graphiteMetric) mergeStaged() {
+	if mt.staged == false || mt.counter == 0 {
+		return
+	}
+
+	for _, r := range mt.rollups {
+		if err := r.merge(mt); err != nil {
+			log.Printf("Graphite.fillBuffer: %v", err)
+		}
+	}
+	mt.reset()
+}
+
+// rollup creates a copy of the metric with an empty state, which is flushed each interval.
+func (mt *graphiteMetric) rollup(interval time.Duration) (*graphiteMetric, error) {
+	r := *mt
+	r.flushInterval = interval
+	r.resolutions = nil
+	r.rollups = nil
+	r.suffix = formatResolution(interval)
+	if err := r.init(); err != nil {
+		return nil, err
+	}
+	r.reset()
+	return &r, nil
+}
+
+// formatResolution formats the interval in the largest whole unit: 10s, 1m, 6h.
+func formatResolution(interval time.Duration) string {
+	switch {
+	case interval%time.Hour == 0:
+		return strconv.FormatInt(int64(interval/time.Hour), 10) + "h"
+	case interval%time.Minute == 0:
+		return strconv.FormatInt(int64(interval/time.Minute), 10) + "m"
+	case interval%time.Second == 0:
+		return strconv.FormatInt(int64(interval/time.Second), 10) + "s"
+	}
+	return strconv.FormatInt(int64(interval/time.Millisecond), 10) + "ms"
 }
 
 func (mt *graphiteMetric) handleValue(value float64) {
+	if len(mt.rollups) > 0 && mt.staged == false {
+		for _, r := range mt.rollups {
+			r.handleValue(value)
+		}
+		return
+	}
+
 	switch mt.mType {
-	case metricCounter:
-		mt.value += value
-	case metricAverage:
-		mt.value = mt.value*(float64(mt.counter)/float64(mt.counter+1)) + value/float64(mt.counter+1)
+	case metricCounter, metricMeter, metricAverage:
+		mt.value, mt.valueCompensation = neumaierAdd(mt.value, mt.valueCompensation, value)
+	case metricDerive:
+		delta, ok := mt.derive(value)
+		if ok == false {
+			return
+		}
+		mt.value, mt.valueCompensation = neumaierAdd(mt.value, mt.valueCompensation, delta)
 	case metricMaximum:
 		if mt.counter == 0 || mt.value < value {
 			mt.value = value
@@ -28,40 +220,305 @@ func (mt *graphiteMetric) handleValue(value float64) {
 		}
 	case metricGauge:
 		mt.value = value
-	case metricHist:
-		var isHit = false
-		for i, v := range mt.histRanges {
-			if value < v {
-				mt.hist[i] += 1
-				isHit = true
-				break
-			}
+	case metricPersistentGauge:
+		mt.value = value
+		mt.hasValue = true
+	case metricHist, metricTimer, metricSummary:
+		// The last value of a summary
+		mt.value = value
+		mt.sum, mt.sumCompensation = neumaierAdd(mt.sum, mt.sumCompensation, value)
+		if mt.counter == 0 || mt.min > value {
+			mt.min = value
 		}
+		if mt.counter == 0 || mt.max < value {
+			mt.max = value
+		}
+		mt.handleHist(value)
+	case metricStats:
+		mt.stats.add(value)
+	case metricSet:
+		mt.set.add(hashFloat64(value))
+	case metricRatio:
+		if value != 0 {
+			mt.value += 1
+		}
+	case metricApdex:
+		switch {
+		case value <= mt.apdexThreshold:
+			mt.apdex[0] += 1
+		case value <= 4*mt.apdexThreshold:
+			mt.apdex[1] += 1
+		default:
+			mt.apdex[2] += 1
+		}
+	case metricTopK:
+		mt.topKeys.add(SanitizeKey(strconv.FormatFloat(value, 'f', -1, 64)))
+	case metricQuantile:
+		mt.sketch.add(value)
+	case metricHDR:
+		mt.hdr.add(value)
+	case metricCustom:
+		mt.aggregator.Observe(value)
+	}
 
-		if isHit == false {
-			mt.hist[len(mt.hist)-1] += 1
+	mt.counter += 1
+}
+
+// derive returns the difference between the total and the previous one. It returns false for a baseline total.
+func (mt *graphiteMetric) derive(total float64) (float64, bool) {
+	previous, hasPrevious := mt.previous, mt.hasPrevious
+	mt.previous = total
+	mt.hasPrevious = true
+
+	switch {
+	case hasPrevious == false:
+		return 0, false
+	case total >= previous:
+		return total - previous, true
+	case mt.wrapAt > 0 && previous <= mt.wrapAt && previous-total > mt.wrapAt/2:
+		// The counter passed wrapAt and started from zero
+		return mt.wrapAt - previous + total, true
+	}
+
+	// The counter was reset
+	return 0, false
+}
+
+// meterWindows are the time constants of the moving averages of a meter.
+var meterWindows = [3]time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// updateRates updates the moving average rates of a meter with the events since the previous flush.
+func (mt *graphiteMetric) updateRates(currentTime time.Time) {
+	elapsed := mt.flushInterval
+	if !mt.lastFlush.IsZero() && currentTime.After(mt.lastFlush) {
+		elapsed = currentTime.Sub(mt.lastFlush)
+	}
+	first := mt.lastFlush.IsZero()
+	mt.lastFlush = currentTime
+
+	rate := mt.total() / elapsed.Seconds()
+	for i, window := range meterWindows {
+		if first {
+			mt.rates[i] = rate
+			continue
 		}
+
+		alpha := 1 - math.Exp(-elapsed.Seconds()/window.Seconds())
+		mt.rates[i] += alpha * (rate - mt.rates[i])
 	}
+}
 
+// handleMember adds the hash of a member to a set.
+func (mt *graphiteMetric) handleMember(hash uint64) {
+	if len(mt.rollups) > 0 && mt.staged == false {
+		for _, r := range mt.rollups {
+			r.handleMember(hash)
+		}
+		return
+	}
+
+	mt.set.add(hash)
 	mt.counter += 1
 }
 
-func (mt *graphiteMetric) get() (float64, int32) {
+// apdexScore returns the Apdex score of the values, from 0 (all frustrated) to 1 (all satisfied).
+func (mt *graphiteMetric) apdexScore() float64 {
+	return (float64(mt.apdex[0]) + float64(mt.apdex[1])/2) / float64(mt.apdex[0]+mt.apdex[1]+mt.apdex[2])
+}
+
+// handleKey counts an occurrence of a sanitized key.
+func (mt *graphiteMetric) handleKey(key string) {
+	if len(mt.rollups) > 0 {
+		for _, r := range mt.rollups {
+			r.handleKey(key)
+		}
+		return
+	}
+
+	mt.topKeys.add(key)
+	mt.counter += 1
+}
+
+// handleAdd changes the value of a persistent gauge by delta. The check applies the value policy to the new value
+// and returns false if the change is discarded.
+func (mt *graphiteMetric) handleAdd(delta float64, check func(value float64) (float64, bool)) {
+	current := mt.value
+	if len(mt.rollups) > 0 {
+		// All resolutions of a gauge have the same value
+		current = mt.rollups[0].value
+	}
+
+	if value, ok := check(current + delta); ok == true {
+		mt.handleValue(value)
+	}
+}
+
+func (mt *graphiteMetric) handleHist(value float64) {
+	var isHit = false
+	for i, v := range mt.histRanges {
+		if value < v {
+			mt.hist[i] += 1
+			isHit = true
+			break
+		}
+	}
+
+	if isHit == false {
+		mt.hist[len(mt.hist)-1] += 1
+	}
+}
+
+func (mt *graphiteMetric) get() (float64, int64) {
+	if mt.mType == metricSet {
+		return math.Round(mt.set.estimate()), mt.counter
+	}
+
+	value := mt.total()
+	if mt.mType == metricAverage && mt.counter > 0 {
+		value /= float64(mt.counter)
+	}
+
 	if mt.normalizeByInterval == true {
-		return mt.value / (float64(mt.flushInterval) / float64(time.Second)), mt.counter
+		return value / (float64(mt.flushInterval) / float64(time.Second)), mt.counter
 	}
 
-	return mt.value, mt.counter
+	return value, mt.counter
 }
 
-func (mt *graphiteMetric) getHist() ([]int32, int32) {
+// total returns the compensated sum of a counter, a meter, a derive or an average.
+func (mt *graphiteMetric) total() float64 {
+	return mt.value + mt.valueCompensation
+}
+
+// neumaierAdd adds x to sum and accumulates the lost low-order bits in compensation (Neumaier's improvement of Kahan summation).
+// Unlike the error of the naive sum, the error of sum + compensation doesn't grow with the number of values.
+func neumaierAdd(sum, compensation, x float64) (float64, float64) {
+	t := sum + x
+	if math.Abs(sum) >= math.Abs(x) {
+		compensation += (sum - t) + x
+	} else {
+		compensation += (x - t) + sum
+	}
+	return t, compensation
+}
+
+func (mt *graphiteMetric) getHist() ([]int64, int64) {
 	return mt.hist, mt.counter
 }
 
+func (mt *graphiteMetric) getStats() (count int64, sum float64, min float64, max float64) {
+	return mt.counter, mt.sum + mt.sumCompensation, mt.min, mt.max
+}
+
+// getQuantiles returns the estimations of the quantiles of the metric.
+func (mt *graphiteMetric) getQuantiles() ([]float64, int64) {
+	values := make([]float64, len(mt.quantiles))
+	for i, q := range mt.quantiles {
+		if mt.mType == metricHDR {
+			values[i] = mt.hdr.quantile(q)
+		} else {
+			values[i] = mt.sketch.quantile(q)
+		}
+	}
+	return values, mt.counter
+}
+
+// collapseHDR counts the values of the log-linear histogram in the buckets of histRanges.
+func (mt *graphiteMetric) collapseHDR() {
+	for i := range mt.hist {
+		mt.hist[i] = 0
+	}
+	mt.hdr.collapse(mt.histRanges, mt.hist)
+}
+
+// quantileName returns the name of the series for the quantile q: p50 for 0.5, p999 for 0.999.
+func quantileName(q float64) string {
+	percentile := strconv.FormatFloat(math.Round(q*1e6)/1e4, 'f', -1, 64)
+	return "p" + strings.Replace(percentile, ".", "", 1)
+}
+
+// histBucketName returns the name of the i-th bucket of the histogram for the naming mode.
+func histBucketName(histRanges []float64, i int, naming HistNaming) string {
+	last := len(histRanges)
+	switch naming {
+	case HistNameBounds:
+		switch i {
+		case 0:
+			return "lt_" + formatBound(histRanges[0])
+		case last:
+			return "ge_" + formatBound(histRanges[last-1])
+		}
+		return formatBound(histRanges[i-1]) + "_" + formatBound(histRanges[i])
+	case HistCumulative:
+		if i == last {
+			return "lt_inf"
+		}
+		return "lt_" + formatBound(histRanges[i])
+	}
+	return strconv.Itoa(i)
+}
+
+// formatBound formats the bound of a bucket for a metric name, where a dot is a separator: 2.5 is formatted as 2p5.
+// A minus would read as a range in the bounds naming, so -2.5 is formatted as m2p5.
+func formatBound(v float64) string {
+	return strings.NewReplacer(".", "p", "-", "m").Replace(strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+// isFresh reports whether a persistent gauge has a value updated not earlier than ttl ago. It is called once per flush.
+func (mt *graphiteMetric) isFresh() bool {
+	if mt.counter > 0 {
+		mt.idle = 0
+	} else {
+		mt.idle += mt.flushInterval
+	}
+
+	return mt.hasValue && (mt.ttl == 0 || mt.idle < mt.ttl)
+}
+
 func (mt *graphiteMetric) reset() {
-	mt.value = 0
+	if mt.mType != metricPersistentGauge {
+		mt.value = 0
+	}
 	mt.counter = 0
+	mt.valueCompensation = 0
+	mt.sum = 0
+	mt.sumCompensation = 0
+	mt.min = 0
+	mt.max = 0
 	for i := range mt.hist {
 		mt.hist[i] = 0
 	}
+	mt.stats = welford{}
+	mt.apdex = [3]int64{}
+	if mt.sketch != nil {
+		mt.sketch.reset()
+	}
+	if mt.hdr != nil {
+		mt.hdr.reset()
+	}
+	if mt.set != nil {
+		mt.set.reset()
+	}
+	if mt.topKeys != nil {
+		mt.topKeys.reset()
+	}
+	if mt.aggregator != nil {
+		mt.aggregator.Reset()
+	}
+}
+
+// checkQuantiles checks that the quantiles are in [0, 1] and have different names.
+func checkQuantiles(quantiles []float64) error {
+	names := make(map[string]bool)
+	for _, q := range quantiles {
+		if !(q >= 0 && q <= 1) {
+			return fmt.Errorf("Quantile (%v) isn't in [0, 1]", q)
+		}
+
+		if names[quantileName(q)] {
+			return fmt.Errorf("Duplicate quantile (%v)", q)
+		}
+		names[quantileName(q)] = true
+	}
+	return nil
 }
@@ -1,6 +1,9 @@
 package graphite
 
 import (
+	"math"
+	"math/big"
+	"math/rand"
 	"reflect"
 	"testing"
 	"time"
@@ -8,7 +11,7 @@ import (
 
 // Test counter
 
-func ValuesTest(values []float64, mType metricType, normalizeByInterval bool, flushInterval time.Duration) (float64, int32) {
+func ValuesTest(values []float64, mType metricType, normalizeByInterval bool, flushInterval time.Duration) (float64, int64) {
 	gm := graphiteMetric{}
 	gm.mType = mType
 	gm.normalizeByInterval = normalizeByInterval
@@ -20,11 +23,11 @@ func ValuesTest(values []float64, mType metricType, normalizeByInterval bool, fl
 	return gm.get()
 }
 
-func CounterValuesTest(values []float64) (float64, int32) {
+func CounterValuesTest(values []float64) (float64, int64) {
 	return ValuesTest(values, metricCounter, false, 0)
 }
 
-func CounterValuesNormalizedTest(values []float64, flushInterval time.Duration) (float64, int32) {
+func CounterValuesNormalizedTest(values []float64, flushInterval time.Duration) (float64, int64) {
 	return ValuesTest(values, metricCounter, true, flushInterval)
 }
 
@@ -84,9 +87,104 @@ func TestCounterNormalized5Values(t *testing.T) {
 	}
 }
 
+// Test Derive
+
+func DeriveValuesTest(values []float64, wrapAt float64) (float64, int64) {
+	gm := graphiteMetric{mType: metricDerive, wrapAt: wrapAt}
+
+	for _, v := range values {
+		gm.handleValue(v)
+	}
+	return gm.get()
+}
+
+func TestDeriveBaseline(t *testing.T) {
+	v, c := DeriveValuesTest([]float64{1000000}, 0)
+
+	if v != 0 || c != 0 {
+		t.Error("Expected 0, got ", v)
+	}
+}
+
+func TestDeriveValues(t *testing.T) {
+	v, c := DeriveValuesTest([]float64{100, 110, 130, 130}, 0)
+
+	if v != 30 || c != 3 {
+		t.Error("Expected 30, got ", v)
+	}
+}
+
+func TestDeriveReset(t *testing.T) {
+	v, c := DeriveValuesTest([]float64{1000000, 1000010, 5, 8}, 0)
+
+	if v != 13 || c != 2 {
+		t.Error("Expected 13, got ", v, c)
+	}
+}
+
+func TestDeriveWrap(t *testing.T) {
+	v, c := DeriveValuesTest([]float64{1<<32 - 10, 5}, 1<<32)
+
+	if v != 15 || c != 1 {
+		t.Error("Expected 15, got ", v)
+	}
+
+	// A small decrease is a reset even with wrapAt
+	v, c = DeriveValuesTest([]float64{1000, 990, 1000}, 1<<32)
+
+	if v != 10 || c != 1 {
+		t.Error("Expected 10, got ", v)
+	}
+}
+
+func TestDeriveAcrossIntervals(t *testing.T) {
+	gm := graphiteMetric{mType: metricDerive, normalizeByInterval: true, flushInterval: 10 * time.Second}
+	gm.handleValue(100)
+	gm.reset()
+	gm.handleValue(150)
+
+	v, c := gm.get()
+	if v != 5 || c != 1 {
+		t.Error("Expected 5 per second, got ", v)
+	}
+}
+
+// Test Meter
+
+func TestMeterRates(t *testing.T) {
+	tm := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	gm := graphiteMetric{mType: metricMeter, flushInterval: 10 * time.Second}
+	for i := 0; i < 100; i++ {
+		gm.handleValue(1)
+	}
+	gm.updateRates(tm)
+
+	if gm.rates != [3]float64{10, 10, 10} {
+		t.Errorf("Expected 10 events/s, got %v", gm.rates)
+	}
+
+	// Two idle intervals of 10s decay the rates just as one missed tick of 20s does
+	a, b := gm, gm
+	a.reset()
+	a.updateRates(tm.Add(10 * time.Second))
+	a.updateRates(tm.Add(20 * time.Second))
+	b.reset()
+	b.updateRates(tm.Add(20 * time.Second))
+
+	for i := range a.rates {
+		if math.Abs(a.rates[i]-b.rates[i]) > 1e-12 {
+			t.Errorf("Expected equal rates, got %v and %v", a.rates, b.rates)
+		}
+	}
+
+	if expected := 10 * math.Exp(-20.0/60); math.Abs(a.rates[0]-expected) > 1e-12 {
+		t.Errorf("Expected m1 rate %v, got %v", expected, a.rates[0])
+	}
+}
+
 // Test Average
 
-func AverageValuesTest(values []float64) (float64, int32) {
+func AverageValuesTest(values []float64) (float64, int64) {
 	return ValuesTest(values, metricAverage, false, 0)
 }
 
@@ -124,7 +222,7 @@ func TestAverage5Values(t *testing.T) {
 
 // Test Maximum
 
-func MaximumValuesTest(values []float64) (float64, int32) {
+func MaximumValuesTest(values []float64) (float64, int64) {
 	return ValuesTest(values, metricMaximum, false, 0)
 }
 
@@ -154,7 +252,7 @@ func TestMaximum3Values(t *testing.T) {
 
 // Test Minimum
 
-func MinimumValuesTest(values []float64) (float64, int32) {
+func MinimumValuesTest(values []float64) (float64, int64) {
 	return ValuesTest(values, metricMinimum, false, 0)
 }
 
@@ -184,7 +282,7 @@ func TestMinimum3Values(t *testing.T) {
 
 // Test Gauge
 
-func GaugeValuesTest(values []float64) (float64, int32) {
+func GaugeValuesTest(values []float64) (float64, int64) {
 	return ValuesTest(values, metricGauge, false, 0)
 }
 
@@ -214,11 +312,11 @@ func TestGauge3Values(t *testing.T) {
 
 // Test Hist
 
-func HistTest(values []float64, histRanges []float64) ([]int32, int32) {
+func HistTest(values []float64, histRanges []float64) ([]int64, int64) {
 	gm := graphiteMetric{}
 	gm.mType = metricHist
 	gm.histRanges = histRanges
-	gm.hist = make([]int32, len(gm.histRanges)+1)
+	gm.hist = make([]int64, len(gm.histRanges)+1)
 
 	for _, v := range values {
 		gm.handleValue(v)
@@ -227,7 +325,7 @@ func HistTest(values []float64, histRanges []float64) ([]int32, int32) {
 }
 
 func TestHist0Values(t *testing.T) {
-	model := []int32{0, 0, 0, 0, 0}
+	model := []int64{0, 0, 0, 0, 0}
 
 	v, c := HistTest([]float64{}, []float64{5, 10, 15, 20})
 
@@ -238,7 +336,7 @@ func TestHist0Values(t *testing.T) {
 }
 
 func TestHist15Values(t *testing.T) {
-	model := []int32{3, 4, 3, 4, 1}
+	model := []int64{3, 4, 3, 4, 1}
 
 	list := []float64{7, 10, -8, 6, 11, 0, 1, 5, 1000000, 17, 17, 17, 19, 6, 10}
 	v, c := HistTest(list, []float64{5, 10, 15, 20})
@@ -249,15 +347,101 @@ func TestHist15Values(t *testing.T) {
 	}
 }
 
+func TestHistBucketName(t *testing.T) {
+	ranges := []float64{2.5, 25, 350}
+	expected := map[HistNaming][]string{
+		HistNameIndex:  {"0", "1", "2", "3"},
+		HistNameBounds: {"lt_2p5", "2p5_25", "25_350", "ge_350"},
+		HistCumulative: {"lt_2p5", "lt_25", "lt_350", "lt_inf"},
+	}
+
+	for naming, names := range expected {
+		for i, name := range names {
+			if n := histBucketName(ranges, i, naming); n != name {
+				t.Errorf("Expected %v, got %v", name, n)
+			}
+		}
+	}
+
+	// A minus is not mistaken for the separator of the bounds
+	negative := []float64{-5, -2.5, 0}
+	expected = map[HistNaming][]string{
+		HistNameBounds: {"lt_m5", "m5_m2p5", "m2p5_0", "ge_0"},
+		HistCumulative: {"lt_m5", "lt_m2p5", "lt_0", "lt_inf"},
+	}
+
+	for naming, names := range expected {
+		for i, name := range names {
+			if n := histBucketName(negative, i, naming); n != name {
+				t.Errorf("Expected %v, got %v", name, n)
+			}
+		}
+	}
+}
+
+// Test Timer
+
+func TestTimerValues(t *testing.T) {
+	gm := graphiteMetric{mType: metricTimer, histRanges: []float64{5}}
+	gm.init()
+
+	for _, v := range []float64{7, 2, 9, 3} {
+		gm.handleValue(v)
+	}
+
+	c, sum, min, max := gm.getStats()
+	if c != 4 || sum != 21 || min != 2 || max != 9 {
+		t.Errorf("Expected 4 21 2 9, got %v %v %v %v", c, sum, min, max)
+	}
+
+	equal := reflect.DeepEqual(gm.hist, []int64{2, 2})
+	if equal != true {
+		t.Errorf("Expected [2 2], got %v", gm.hist)
+	}
+
+	gm.reset()
+	c, sum, min, max = gm.getStats()
+	if c != 0 || sum != 0 || min != 0 || max != 0 {
+		t.Errorf("Expected zero stats after reset, got %v %v %v %v", c, sum, min, max)
+	}
+}
+
+// Test Quantile
+
+func TestQuantileName(t *testing.T) {
+	quantiles := []float64{0, 0.5, 0.9, 0.99, 0.999, 0.9999, 1}
+	expected := []string{"p0", "p50", "p90", "p99", "p999", "p9999", "p100"}
+
+	for i, q := range quantiles {
+		if name := quantileName(q); name != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], name)
+		}
+	}
+}
+
+func TestQuantileValues(t *testing.T) {
+	gm := graphiteMetric{mType: metricQuantile, quantiles: []float64{0.5, 1}, relativeAccuracy: 0.01}
+	gm.init()
+
+	for i := 1; i <= 101; i++ {
+		gm.handleValue(float64(i))
+	}
+
+	values, c := gm.getQuantiles()
+	if c != 101 || math.Abs(values[0]-51) > 0.51 || values[1] != 101 {
+		t.Errorf("Expected [51 101] 101, got %v %v", values, c)
+	}
+}
+
 func TestReset(t *testing.T) {
 	gm := graphiteMetric{
-		metricCounter,
-		42,
-		3,
-		true,
-		3 * time.Second,
-		[]float64{5, 10, 15, 20},
-		[]int32{3, 4, 3, 4, 1}}
+		mType:               metricCounter,
+		value:               42,
+		counter:             3,
+		normalizeByInterval: true,
+		flushInterval:       3 * time.Second,
+		histRanges:          []float64{5, 10, 15, 20},
+		hist:                []int64{3, 4, 3, 4, 1}}
 	gm.reset()
 
 	if gm.mType != metricCounter {
@@ -285,12 +469,121 @@ func TestReset(t *testing.T) {
 		t.Errorf("Expected [5, 10, 15, 20], got %v", gm.histRanges)
 	}
 
-	equal = reflect.DeepEqual(gm.hist, []int32{0, 0, 0, 0, 0})
+	equal = reflect.DeepEqual(gm.hist, []int64{0, 0, 0, 0, 0})
 	if equal != true {
 		t.Errorf("Expected [0, 0, 0, 0, 0], got %v", gm.hist)
 	}
 }
 
+func TestFormatResolution(t *testing.T) {
+	intervals := []time.Duration{10 * time.Second, time.Minute, 90 * time.Second, 6 * time.Hour, 1500 * time.Millisecond}
+	expected := []string{"10s", "1m", "90s", "6h", "1500ms"}
+
+	for i, interval := range intervals {
+		if s := formatResolution(interval); s != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], s)
+		}
+	}
+}
+
+func TestRollup(t *testing.T) {
+	gm := graphiteMetric{mType: metricHist, histRanges: []float64{1, 2}, flushInterval: time.Second}
+	gm.init()
+	gm.handleValue(1.5)
+
+	r, _ := gm.rollup(time.Minute)
+	if r.flushInterval != time.Minute || r.suffix != "1m" {
+		t.Errorf("Expected 1m rollup, got %v %v", r.flushInterval, r.suffix)
+	}
+
+	equal := reflect.DeepEqual(r.hist, []int64{0, 0, 0})
+	if equal != true || r.counter != 0 {
+		t.Errorf("Expected empty hist, got %v", r.hist)
+	}
+
+	r.handleValue(0)
+	equal = reflect.DeepEqual(gm.hist, []int64{0, 1, 0})
+	if equal != true {
+		t.Errorf("Rollup shares the hist with the metric: %v", gm.hist)
+	}
+}
+
+// exactSum returns the sum of the values rounded to float64 once.
+func exactSum(values []float64) float64 {
+	sum := new(big.Float).SetPrec(2048)
+	for _, v := range values {
+		sum.Add(sum, new(big.Float).SetFloat64(v))
+	}
+	f, _ := sum.Float64()
+	return f
+}
+
+func TestCounterPrecision(t *testing.T) {
+	// Each 1 is lost in the naive sum, since the spacing of float64 at 1e16 is 2
+	values := []float64{1e16}
+	for i := 0; i < 1000; i++ {
+		values = append(values, 1)
+	}
+
+	if v, _ := CounterValuesTest(values); v != exactSum(values) || v != 1e16+1000 {
+		t.Errorf("Expected %v, got %v", exactSum(values), v)
+	}
+}
+
+func TestCounterPrecisionRandom(t *testing.T) {
+	// Values of different magnitudes and signs
+	r := rand.New(rand.NewSource(1))
+	values := make([]float64, 1000000)
+	for i := range values {
+		values[i] = r.NormFloat64() * math.Pow(10, float64(r.Intn(12)))
+	}
+
+	exact := exactSum(values)
+	v, _ := CounterValuesTest(values)
+	if math.Abs(v-exact) > 2*math.Abs(math.Nextafter(exact, math.Inf(1))-exact) {
+		t.Errorf("Expected %v, got %v", exact, v)
+	}
+}
+
+func TestAveragePrecision(t *testing.T) {
+	values := make([]float64, 1000000)
+	for i := range values {
+		values[i] = 0.1
+	}
+	values = append(values, 1e9, -1e9)
+
+	exact := exactSum(values) / float64(len(values))
+	if v, c := AverageValuesTest(values); v != exact || c != int64(len(values)) {
+		t.Errorf("Expected %v, got %v", exact, v)
+	}
+}
+
+func TestHistSumPrecision(t *testing.T) {
+	gm := graphiteMetric{mType: metricHist, histRanges: []float64{1}}
+	gm.init()
+	values := []float64{1e16, 1, 1, 1, 1}
+	for _, v := range values {
+		gm.handleValue(v)
+	}
+
+	if _, sum, _, _ := gm.getStats(); sum != exactSum(values) {
+		t.Errorf("Expected %v, got %v", exactSum(values), sum)
+	}
+}
+
+func TestCount64(t *testing.T) {
+	gm := graphiteMetric{mType: metricHist, histRanges: []float64{1}}
+	gm.init()
+	gm.counter = math.MaxInt32
+	gm.hist[0] = math.MaxInt32
+	gm.handleValue(0)
+
+	hist, c := gm.getHist()
+	if c != math.MaxInt32+1 || hist[0] != math.MaxInt32+1 {
+		t.Errorf("Expected %v, got %v %v", int64(math.MaxInt32+1), c, hist[0])
+	}
+}
+
 func BenchmarkHandleCounter(b *testing.B) {
 	gm := graphiteMetric{}
 	gm.mType = metricCounter
@@ -313,7 +606,7 @@ func BenchmarkHandleHist(b *testing.B) {
 	gm := graphiteMetric{}
 	gm.mType = metricHist
 	gm.histRanges = []float64{500, 1000000, 10000000, 20000000}
-	gm.hist = make([]int32, len(gm.histRanges)+1)
+	gm.hist = make([]int64, len(gm.histRanges)+1)
 
 	for i := 0; i < b.N; i++ {
 		gm.handleValue(float64(i))
@@ -0,0 +1,181 @@
+package graphite
+
+import "time"
+
+// Option configures a Graphite. Options are passed to NewGraphite.
+type Option func(*Graphite)
+
+// WithClock replaces the clock used for flush scheduling and timestamps. By default the time package is used.
+func WithClock(clock Clock) Option {
+	return func(graphite *Graphite) {
+		if clock != nil {
+			graphite.clock = clock
+		}
+	}
+}
+
+// WindowStamp selects which edge of the aggregation window is used as the timestamp of the points in aligned mode.
+type WindowStamp int8
+
+const (
+	// StampWindowStart stamps each point with the start of the window it covers.
+	StampWindowStart WindowStamp = iota
+	// StampWindowEnd stamps each point with the end of the window it covers.
+	StampWindowEnd
+)
+
+// WithAlignedFlush makes Graphite flush at multiples of flushInterval since the epoch instead of every flushInterval since Start.
+// Each point is stamped with the start or the end of the aggregation window, so instances started at different moments put the data for the same interval in the same carbon bucket.
+func WithAlignedFlush(stamp WindowStamp) Option {
+	return func(graphite *Graphite) {
+		graphite.aligned = true
+		graphite.windowStamp = stamp
+	}
+}
+
+// JitterMode selects how the send delay is chosen by WithSendJitter.
+type JitterMode int8
+
+const (
+	// JitterRandom delays each send by a new random duration.
+	JitterRandom JitterMode = iota
+	// JitterHostname delays each send by a constant duration derived from the hash of the hostname.
+	// The delay is computed once in NewGraphite, which fails if the hostname is not available.
+	JitterHostname
+)
+
+// WithSendJitter delays sending the metrics to the server by up to maxDelay after the aggregation interval is closed.
+// The timestamps still match the interval, but the load on the relays from thousands of instances is spread over the interval.
+// The maxDelay must be less than flushInterval.
+func WithSendJitter(maxDelay time.Duration, mode JitterMode) Option {
+	return func(graphite *Graphite) {
+		graphite.sendJitter = maxDelay
+		graphite.jitterMode = mode
+	}
+}
+
+// WithIdleZeros makes all counters and histograms send zeros for the intervals without values instead of skipping them.
+// It may be overridden for a metric with MetricIdleZeros.
+func WithIdleZeros() Option {
+	return func(graphite *Graphite) {
+		graphite.idleZeros = true
+	}
+}
+
+// WithCollectTimeout sets how long a flush waits for the collectors (see Collector), as measured by the clock of Graphite. The default is 100ms.
+func WithCollectTimeout(timeout time.Duration) Option {
+	return func(graphite *Graphite) {
+		if timeout > 0 {
+			graphite.collectTimeout = timeout
+		}
+	}
+}
+
+// WithValuePolicy sets the policy for invalid values of all metrics: NaN, infinite values and finite values out of [min, max].
+// Pass math.Inf(-1) and math.Inf(1) to check for NaN and infinite values only; ValueClamp requires finite bounds.
+// It may be overridden for a metric with MetricValuePolicy. The numbers of rejected, dropped and clamped values are sent
+// each interval as graphite.values.rejected, graphite.values.dropped and graphite.values.clamped.
+// The policy doesn't apply to ratio, meter, set and top-k metrics, whose values encode events and members.
+func WithValuePolicy(policy ValuePolicy, min float64, max float64) Option {
+	return func(graphite *Graphite) {
+		graphite.valuePolicy = valuePolicy{policy, min, max}
+	}
+}
+
+// MetricOption configures a metric. Options are passed to the Register* functions.
+// The same options may be passed to a group of metrics, for example to give all business counters a one minute resolution.
+type MetricOption func(*graphiteMetric)
+
+// MetricInterval sets the flush interval of the metric. By default it is the flushInterval of Graphite.
+// The interval must be a multiple of the flushInterval of Graphite. Counters normalized by interval are divided by this interval.
+func MetricInterval(interval time.Duration) MetricOption {
+	return func(mt *graphiteMetric) {
+		mt.flushInterval = interval
+	}
+}
+
+// MetricResolutions makes the metric emit several series, one per resolution, instead of a single one.
+// Each series is aggregated independently from the same values and named after its resolution, for example name.10s and name.1m.
+// Each resolution must be a multiple of the flushInterval of Graphite.
+func MetricResolutions(resolutions ...time.Duration) MetricOption {
+	return func(mt *graphiteMetric) {
+		mt.resolutions = append([]time.Duration(nil), resolutions...)
+	}
+}
+
+// HistNaming selects how the buckets of a histogram are named.
+type HistNaming int8
+
+const (
+	// HistNameIndex names the buckets by their index: name.0, name.1, ...
+	HistNameIndex HistNaming = iota
+	// HistNameBounds names the buckets by their bounds: name.lt_10, name.10_25, ..., name.ge_350.
+	HistNameBounds
+	// HistCumulative sends cumulative counts named by the upper bound, as expected by Grafana heatmaps: name.lt_10, name.lt_25, ..., name.lt_inf.
+	// As with all buckets of this package, the upper bound is exclusive: name.lt_10 counts the values less than 10.
+	HistCumulative
+)
+
+// MetricHistNaming sets the naming of the buckets of a histogram or a timer. A dot in a bound is replaced by "p" and a minus by "m": -2.5 is named m2p5.
+func MetricHistNaming(naming HistNaming) MetricOption {
+	return func(mt *graphiteMetric) {
+		mt.histNaming = naming
+	}
+}
+
+// MetricHistStats makes a histogram also send the name.count, name.sum, name.min and name.max series of its values.
+func MetricHistStats() MetricOption {
+	return func(mt *graphiteMetric) {
+		mt.histStats = true
+	}
+}
+
+// HistOutput is a set of series sent for the buckets of a histogram. Combine the values with |.
+type HistOutput int8
+
+const (
+	// HistCounts sends the number of values in each bucket.
+	HistCounts HistOutput = 1 << iota
+	// HistPercent sends the percentage of the values of the interval in each bucket as name.pct.<bucket>.
+	// With the HistCumulative naming the percentages are cumulative too.
+	HistPercent
+	// HistCumulativePercent sends the percentage of the values of the interval less than the upper bound of each bucket
+	// as name.pct_lt.lt_<bound>, which directly answers "what percentage of requests took less than X".
+	HistCumulativePercent
+)
+
+// MetricHistOutput sets the series sent for the buckets of a histogram or a timer. By default only HistCounts are sent.
+func MetricHistOutput(output HistOutput) MetricOption {
+	return func(mt *graphiteMetric) {
+		if output != 0 {
+			mt.histOutput = output
+		}
+	}
+}
+
+// MetricIdleZeros sets whether a counter, a histogram, a timer or an HDR histogram sends zeros for the intervals without values.
+// Zeros are sent for counts and sums only; averages, minimums, maximums and quantiles of an idle interval are still skipped,
+// since zero would be a lie for them.
+func MetricIdleZeros(emit bool) MetricOption {
+	return func(mt *graphiteMetric) {
+		mt.idleZeros = emit
+	}
+}
+
+// MetricWrapAt sets the value after which a cumulative counter (see RegisterDerive) wraps around to zero, for example 1<<32 for a 32-bit counter.
+// A total that is less than the previous one by more than half of wrapAt is treated as a wraparound, not as a reset.
+func MetricWrapAt(wrapAt float64) MetricOption {
+	return func(mt *graphiteMetric) {
+		mt.wrapAt = wrapAt
+	}
+}
+
+// MetricValuePolicy sets the policy for invalid values of the metric (see WithValuePolicy).
+// The policy applies to the values and to the new value of a gauge changed by GaugeMetric.Add, Inc or Dec, but not to the members
+// of sets and the keys of top-K metrics. A change that would make a gauge invalid is clamped or discarded; with ValueReject
+// it is counted as rejected, but the error can't be returned, since the new value is known only when the change is processed.
+func MetricValuePolicy(policy ValuePolicy, min float64, max float64) MetricOption {
+	return func(mt *graphiteMetric) {
+		mt.valuePolicy = valuePolicy{policy, min, max}
+	}
+}
@@ -0,0 +1,108 @@
+package graphite
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ValuePolicy selects how a metric handles invalid values: NaN, infinite values and values out of the bounds of the policy.
+// A single NaN would otherwise turn a counter, an average or a maximum into NaN for the whole interval.
+type ValuePolicy int8
+
+const (
+	// ValueAccept processes all values as is. This is the default.
+	ValueAccept ValuePolicy = iota
+	// ValueReject discards invalid values and returns an error from HandleValue.
+	ValueReject
+	// ValueDrop silently discards invalid values.
+	ValueDrop
+	// ValueClamp replaces values out of the bounds, including infinite ones, with the nearest bound. NaN values are dropped.
+	ValueClamp
+)
+
+// valuePolicy is a ValuePolicy with the bounds of valid values.
+type valuePolicy struct {
+	policy ValuePolicy
+	min    float64
+	max    float64
+}
+
+// valueCounts counts the invalid values of all metrics. It is updated from any goroutine and sent as self-metrics.
+// It is allocated separately to keep the counters 64-bit aligned for the atomic operations.
+type valueCounts struct {
+	rejected int64
+	dropped  int64
+	clamped  int64
+}
+
+// checkValuePolicy checks that the bounds of the policy are valid.
+func checkValuePolicy(p valuePolicy) error {
+	if p.policy < ValueAccept || p.policy > ValueClamp {
+		return fmt.Errorf("Unknown value policy (%v)", p.policy)
+	}
+
+	if p.policy == ValueAccept {
+		return nil
+	}
+
+	if !(p.min <= p.max) {
+		return fmt.Errorf("Invalid bounds [%v, %v] of value policy", p.min, p.max)
+	}
+
+	if p.policy == ValueClamp && (math.IsInf(p.min, 0) || math.IsInf(p.max, 0)) {
+		return fmt.Errorf("Infinite bounds [%v, %v] of clamp value policy", p.min, p.max)
+	}
+
+	return nil
+}
+
+// checkValue applies the value policy of the metric to the value. It returns the value to process and false if the value is discarded.
+// NaN and infinite values are always invalid, finite values are invalid out of [min, max].
+func (gr *Graphite) checkValue(mt *graphiteMetric, name string, value float64) (float64, bool, error) {
+	switch mt.mType {
+	case metricRatio, metricMeter, metricSet, metricTopK:
+		// The values of these metrics encode events and members, not measurements
+		return value, true, nil
+	}
+
+	p := mt.valuePolicy
+	if p.policy == ValueAccept || (value >= p.min && value <= p.max && !math.IsInf(value, 0)) {
+		return value, true, nil
+	}
+
+	switch p.policy {
+	case ValueReject:
+		atomic.AddInt64(&gr.valueCounts.rejected, 1)
+		return 0, false, fmt.Errorf("HandleValue: Value %v of metric %s isn't a finite number in [%v, %v]", value, name, p.min, p.max)
+	case ValueClamp:
+		if math.IsNaN(value) {
+			break
+		}
+		atomic.AddInt64(&gr.valueCounts.clamped, 1)
+		return math.Max(p.min, math.Min(p.max, value)), true, nil
+	}
+
+	atomic.AddInt64(&gr.valueCounts.dropped, 1)
+	return 0, false, nil
+}
+
+// writeValueCounts sends the numbers of invalid values since the previous flush as graphite.values.rejected,
+// graphite.values.dropped and graphite.values.clamped, if any metric has a value policy.
+func (gr *Graphite) writeValueCounts(currentTime time.Time) {
+	if gr.validating == false {
+		return
+	}
+
+	stamp := currentTime
+	if gr.aligned == true && gr.windowStamp == StampWindowStart {
+		stamp = gr.windowStart
+	}
+	current_time := strconv.FormatInt(stamp.Unix(), 10)
+
+	gr.writeLine("graphite.values.rejected", strconv.FormatInt(atomic.SwapInt64(&gr.valueCounts.rejected, 0), 10), current_time)
+	gr.writeLine("graphite.values.dropped", strconv.FormatInt(atomic.SwapInt64(&gr.valueCounts.dropped, 0), 10), current_time)
+	gr.writeLine("graphite.values.clamped", strconv.FormatInt(atomic.SwapInt64(&gr.valueCounts.clamped, 0), 10), current_time)
+}
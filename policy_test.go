@@ -0,0 +1,193 @@
+package graphite
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCheckValuePolicy(t *testing.T) {
+	tests := []struct {
+		policy valuePolicy
+		valid  bool
+	}{
+		{valuePolicy{ValueAccept, 0, 0}, true},
+		{valuePolicy{ValueReject, math.Inf(-1), math.Inf(1)}, true},
+		{valuePolicy{ValueDrop, 0, 100}, true},
+		{valuePolicy{ValueClamp, -1, 1}, true},
+		{valuePolicy{ValueDrop, 1, 0}, false},
+		{valuePolicy{ValueReject, math.NaN(), 1}, false},
+		{valuePolicy{ValueClamp, 0, math.Inf(1)}, false},
+		{valuePolicy{ValueClamp + 1, 0, 1}, false},
+	}
+
+	for _, test := range tests {
+		if err := checkValuePolicy(test.policy); (err == nil) != test.valid {
+			t.Errorf("Expected valid %v for %v, got error(%v)", test.valid, test.policy, err)
+		}
+	}
+
+	if _, err := NewGraphite("", 0, "prefix", time.Second, false, WithValuePolicy(ValueClamp, 0, math.Inf(1))); err == nil {
+		t.Error("Expected error for infinite clamp bound")
+	}
+
+	graph, _ := NewGraphite("", 0, "prefix", time.Second, false)
+	if err := graph.RegisterCounter("counter", false, MetricValuePolicy(ValueDrop, 1, 0)); err == nil {
+		t.Error("Expected error for invalid bounds")
+	}
+}
+
+func TestCheckValue(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", time.Second, false)
+	tests := []struct {
+		policy   ValuePolicy
+		value    float64
+		expected float64
+		ok       bool
+		err      bool
+	}{
+		{ValueAccept, math.NaN(), math.NaN(), true, false},
+		{ValueAccept, 1000, 1000, true, false},
+		{ValueReject, 5, 5, true, false},
+		{ValueReject, math.NaN(), 0, false, true},
+		{ValueReject, 11, 0, false, true},
+		{ValueDrop, math.Inf(1), 0, false, false},
+		{ValueDrop, -1, 0, false, false},
+		{ValueClamp, 11, 10, true, false},
+		{ValueClamp, math.Inf(-1), 0, true, false},
+		{ValueClamp, math.NaN(), 0, false, false},
+	}
+
+	for _, test := range tests {
+		mt := &graphiteMetric{valuePolicy: valuePolicy{test.policy, 0, 10}}
+		value, ok, err := graph.checkValue(mt, "metric", test.value)
+		if ok != test.ok || (err != nil) != test.err || (ok == true && value != test.expected && !(math.IsNaN(value) && math.IsNaN(test.expected))) {
+			t.Errorf("Expected %v %v %v for %v of policy %v, got %v %v %v", test.expected, test.ok, test.err, test.value, test.policy, value, ok, err)
+		}
+	}
+
+	counts := *graph.valueCounts
+	if counts != (valueCounts{rejected: 2, dropped: 3, clamped: 2}) {
+		t.Errorf("Expected 2 rejected, 3 dropped and 2 clamped values, got %+v", counts)
+	}
+}
+
+func TestValuePolicy(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock), WithValuePolicy(ValueReject, math.Inf(-1), math.Inf(1)))
+	graph.RegisterCounter("counter", false)
+	graph.RegisterMaximum("maximum", MetricValuePolicy(ValueDrop, 0, 100))
+	graph.RegisterAverage("average", MetricValuePolicy(ValueClamp, 0, 100))
+	graph.RegisterGauge("gauge", MetricValuePolicy(ValueAccept, 0, 0))
+	graph.RegisterCollector(CollectorFunc(func(report func(string, float64)) {
+		report("counter", math.NaN())
+	}))
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+
+	if err := graph.HandleValue("counter", math.NaN()); err == nil {
+		t.Error("Expected error for NaN")
+	}
+	if err := graph.HandleValue("counter", 2); err != nil {
+		t.Errorf("HandleValue() got error(%v)", err)
+	}
+	if err := graph.HandleValue("maximum", 1000); err != nil {
+		t.Errorf("HandleValue() got error(%v)", err)
+	}
+	graph.HandleValue("maximum", 50)
+	graph.HandleValue("average", -100)
+	graph.HandleValue("average", 1e9)
+	graph.HandleValue("gauge", math.Inf(1))
+	clock.Advance(10 * time.Second)
+
+	expected := []string{
+		"prefix.average 50.000000000000 946782255",
+		"prefix.counter 2.000000000000 946782255",
+		"prefix.gauge +Inf 946782255",
+		"prefix.graphite.values.clamped 2 946782255",
+		"prefix.graphite.values.dropped 1 946782255",
+		"prefix.graphite.values.rejected 2 946782255",
+		"prefix.maximum 50.000000000000 946782255",
+	}
+	assertLines(t, c.waitOutput(), expected)
+	graph.Stop()
+}
+
+func TestValuePolicyEncodedValues(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock), WithValuePolicy(ValueClamp, 5, 1000))
+	ratio, _ := graph.RegisterRatio("errors")
+	set, _ := graph.RegisterSet("users", 12)
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+
+	// Neither the 0 and 1 of the ratio nor the members of the set are clamped to 5
+	ratio.Hit()
+	ratio.Miss()
+	ratio.Miss()
+	for _, v := range []float64{1, 2, 3} {
+		graph.HandleValue("users", v)
+	}
+	set.AddUint64(4)
+	clock.Advance(10 * time.Second)
+
+	expected := []string{
+		"prefix.errors.denominator 3 946782255",
+		"prefix.errors.numerator 1 946782255",
+		"prefix.errors.ratio 0.333333333333 946782255",
+		"prefix.graphite.values.clamped 0 946782255",
+		"prefix.graphite.values.dropped 0 946782255",
+		"prefix.graphite.values.rejected 0 946782255",
+		"prefix.users 4 946782255",
+	}
+	assertLines(t, c.waitOutput(), expected)
+	graph.Stop()
+
+	graph, _ = NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock), WithValuePolicy(ValueReject, 10, 1000))
+	ratio, _ = graph.RegisterRatio("errors")
+	graph.Start()
+	if err := ratio.Hit(); err != nil {
+		t.Errorf("Hit() got error(%v)", err)
+	}
+	if err := ratio.Miss(); err != nil {
+		t.Errorf("Miss() got error(%v)", err)
+	}
+	graph.Stop()
+}
+
+func TestValuePolicyGauge(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock))
+	clamp, _ := graph.RegisterPersistentGauge("clamp", 0, MetricValuePolicy(ValueClamp, 0, 100))
+	drop, _ := graph.RegisterPersistentGauge("drop", 0, MetricValuePolicy(ValueDrop, 0, 100))
+	reject, _ := graph.RegisterPersistentGauge("reject", 0, MetricValuePolicy(ValueReject, 0, 100), MetricResolutions(10*time.Second, 20*time.Second))
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+
+	// The policy applies to the new value, not to the delta, so decrements within the bounds are processed
+	for _, gauge := range []*GaugeMetric{clamp, drop, reject} {
+		errs := []error{gauge.Set(3), gauge.Dec(), gauge.Dec(), gauge.Dec(), gauge.Dec(), gauge.Inc(), gauge.Add(60), gauge.Add(60), gauge.Add(-10)}
+		for _, err := range errs {
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		}
+	}
+	clamp.Add(math.NaN())
+	clock.Advance(10 * time.Second)
+
+	// clamp: 3 2 1 0 0 1 61 100 90; drop and reject: 3 2 1 0 0 1 61 61 51
+	expected := []string{
+		"prefix.clamp 90.000000000000 946782255",
+		"prefix.drop 51.000000000000 946782255",
+		"prefix.graphite.values.clamped 2 946782255",
+		"prefix.graphite.values.dropped 3 946782255",
+		"prefix.graphite.values.rejected 2 946782255",
+		"prefix.reject.10s 51.000000000000 946782255",
+	}
+	assertLines(t, c.waitOutput(), expected)
+	graph.Stop()
+}
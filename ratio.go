@@ -0,0 +1,26 @@
+package graphite
+
+// RatioMetric counts hits and misses of a metric registered with RegisterRatio.
+// Multiple goroutines may invoke methods on a RatioMetric simultaneously.
+type RatioMetric struct {
+	graphite *Graphite
+	name     string
+}
+
+// Hit counts an event in both the numerator and the denominator, for example a cache hit or a failed request.
+func (r *RatioMetric) Hit() error {
+	return r.graphite.HandleValue(r.name, 1)
+}
+
+// Miss counts an event in the denominator only.
+func (r *RatioMetric) Miss() error {
+	return r.graphite.HandleValue(r.name, 0)
+}
+
+// Observe counts a hit if hit is true and a miss otherwise.
+func (r *RatioMetric) Observe(hit bool) error {
+	if hit == true {
+		return r.Hit()
+	}
+	return r.Miss()
+}
@@ -0,0 +1,32 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRatioMetric(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock))
+	ratio, err := graph.RegisterRatio("errors")
+	if err != nil {
+		t.Errorf("RegisterRatio() got error(%v)", err)
+	}
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+
+	ratio.Hit()
+	ratio.Miss()
+	ratio.Miss()
+	ratio.Observe(false)
+	clock.Advance(10 * time.Second)
+
+	expected := "prefix.errors.ratio 0.250000000000 946782255\n" +
+		"prefix.errors.numerator 1 946782255\n" +
+		"prefix.errors.denominator 4 946782255\n"
+	if output := c.waitOutput(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+	graph.Stop()
+}
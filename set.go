@@ -0,0 +1,18 @@
+package graphite
+
+// SetMetric adds members to a metric registered with RegisterSet.
+// Multiple goroutines may invoke methods on a SetMetric simultaneously.
+type SetMetric struct {
+	graphite *Graphite
+	name     string
+}
+
+// AddString adds the member to the set.
+func (s *SetMetric) AddString(member string) error {
+	return s.graphite.sendValue(graphiteValue{name: s.name, hash: hashString(member), op: opMember})
+}
+
+// AddUint64 adds the member to the set.
+func (s *SetMetric) AddUint64(member uint64) error {
+	return s.graphite.sendValue(graphiteValue{name: s.name, hash: hashUint64(member), op: opMember})
+}
@@ -0,0 +1,32 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetMetric(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock))
+	set, err := graph.RegisterSet("users", 10)
+	if err != nil {
+		t.Errorf("RegisterSet() got error(%v)", err)
+	}
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+
+	set.AddString("alice")
+	set.AddString("bob")
+	set.AddString("alice")
+	set.AddUint64(1)
+	set.AddUint64(1)
+	graph.HandleValue("users", 1)
+	clock.Advance(10 * time.Second)
+
+	expected := "prefix.users 3 946782255\n"
+	if output := c.waitOutput(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+	graph.Stop()
+}
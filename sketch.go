@@ -0,0 +1,200 @@
+package graphite
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	sketchMaxBins      = 2048
+	sketchMinIndexable = 1e-9
+)
+
+// ddSketch is a quantile sketch (DDSketch, Masson et al., 2019).
+// Values are counted in logarithmic bins of width gamma = (1+alpha)/(1-alpha), so any quantile is estimated
+// with the relative error of at most alpha, as long as the bins of the quantile haven't been collapsed.
+// Each of the positive and negative stores keeps at most sketchMaxBins bins; when a store grows above it,
+// the lowest bins are collapsed into one. With alpha = 0.01 that happens only if the values span more than 17 orders of magnitude.
+// Values with an absolute value less than sketchMinIndexable are counted as zeros.
+// Two sketches with the same alpha can be merged without loss of accuracy, which combines the values of a metric into each of its resolutions.
+type ddSketch struct {
+	alpha    float64
+	logGamma float64
+	positive ddStore
+	negative ddStore
+	zeros    int64
+	count    int64
+	min      float64
+	max      float64
+}
+
+// ddStore is a dense array of bin counters. bins[0] is the bin with index offset.
+type ddStore struct {
+	bins   []int64
+	offset int
+}
+
+func newDDSketch(alpha float64) *ddSketch {
+	s := new(ddSketch)
+	s.alpha = alpha
+	s.logGamma = math.Log((1 + alpha) / (1 - alpha))
+	return s
+}
+
+func (s *ddSketch) add(value float64) {
+	switch {
+	case value >= sketchMinIndexable:
+		s.positive.add(s.index(value), 1)
+	case value <= -sketchMinIndexable:
+		s.negative.add(s.index(-value), 1)
+	default:
+		s.zeros += 1
+	}
+
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+	s.count += 1
+}
+
+func (s *ddSketch) index(value float64) int {
+	return int(math.Ceil(math.Log(value) / s.logGamma))
+}
+
+// value returns the value of the bin with relative distance of at most alpha to all values of the bin.
+func (s *ddSketch) value(index int) float64 {
+	return 2 * math.Exp(float64(index)*s.logGamma) / (1 + math.Exp(s.logGamma))
+}
+
+// quantile returns the estimation of the q-quantile, 0 <= q <= 1.
+func (s *ddSketch) quantile(q float64) float64 {
+	switch {
+	case s.count == 0:
+		return 0
+	case q <= 0:
+		return s.min
+	case q >= 1:
+		return s.max
+	}
+
+	rank := int64(q * float64(s.count-1))
+	var v float64
+	var n int64
+
+	// Negative values from the most negative, then zeros, then positive values
+	found := false
+	for i := len(s.negative.bins) - 1; i >= 0 && !found; i-- {
+		n += s.negative.bins[i]
+		if n > rank {
+			v = -s.value(s.negative.offset + i)
+			found = true
+		}
+	}
+
+	if !found {
+		n += s.zeros
+		if n > rank {
+			found = true
+		}
+	}
+
+	for i := 0; i < len(s.positive.bins) && !found; i++ {
+		n += s.positive.bins[i]
+		if n > rank {
+			v = s.value(s.positive.offset + i)
+			found = true
+		}
+	}
+
+	return math.Max(s.min, math.Min(s.max, v))
+}
+
+// merge adds all values of other to the sketch.
+func (s *ddSketch) merge(other *ddSketch) error {
+	if s.alpha != other.alpha {
+		return fmt.Errorf("ddSketch.merge: Relative accuracy %v != %v", s.alpha, other.alpha)
+	}
+
+	if other.count == 0 {
+		return nil
+	}
+
+	for i, c := range other.positive.bins {
+		s.positive.add(other.positive.offset+i, c)
+	}
+	for i, c := range other.negative.bins {
+		s.negative.add(other.negative.offset+i, c)
+	}
+	s.zeros += other.zeros
+
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	return nil
+}
+
+func (s *ddSketch) reset() {
+	s.positive.reset()
+	s.negative.reset()
+	s.zeros = 0
+	s.count = 0
+	s.min = 0
+	s.max = 0
+}
+
+func (st *ddStore) add(index int, count int64) {
+	if count == 0 {
+		return
+	}
+
+	if len(st.bins) == 0 {
+		st.bins = append(st.bins[:0], count)
+		st.offset = index
+		return
+	}
+
+	if index < st.offset {
+		// Lower than the collapsed bins
+		if st.offset+len(st.bins)-index > sketchMaxBins && len(st.bins) == sketchMaxBins {
+			st.bins[0] += count
+			return
+		}
+
+		grow := st.offset - index
+		st.bins = append(make([]int64, grow, grow+len(st.bins)), st.bins...)
+		st.offset = index
+	} else if last := st.offset + len(st.bins) - 1; index > last {
+		st.bins = append(st.bins, make([]int64, index-last)...)
+	}
+
+	st.bins[index-st.offset] += count
+	st.collapse()
+}
+
+// collapse merges the lowest bins, so that the store keeps at most sketchMaxBins bins.
+func (st *ddStore) collapse() {
+	extra := len(st.bins) - sketchMaxBins
+	if extra <= 0 {
+		return
+	}
+
+	var sum int64
+	for _, c := range st.bins[:extra+1] {
+		sum += c
+	}
+	st.bins = append(st.bins[:0], st.bins[extra:]...)
+	st.bins[0] = sum
+	st.offset += extra
+}
+
+func (st *ddStore) reset() {
+	st.bins = st.bins[:0]
+	st.offset = 0
+}
@@ -0,0 +1,117 @@
+package graphite
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func checkSketchAccuracy(t *testing.T, values []float64, alpha float64) {
+	s := newDDSketch(alpha)
+	for _, v := range values {
+		s.add(v)
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	for _, q := range []float64{0, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999, 1} {
+		exact := exactQuantile(sorted, q)
+		estimated := s.quantile(q)
+		if math.Abs(estimated-exact) > alpha*math.Abs(exact)+1e-12 {
+			t.Errorf("q=%v: expected %v with relative error %v, got %v", q, exact, alpha, estimated)
+		}
+	}
+}
+
+func TestSketchAccuracyLogNormal(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	values := make([]float64, 100000)
+	for i := range values {
+		values[i] = math.Exp(r.NormFloat64()*2 + 3)
+	}
+
+	checkSketchAccuracy(t, values, 0.01)
+	checkSketchAccuracy(t, values, 0.005)
+}
+
+func TestSketchAccuracyMixedSigns(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	values := make([]float64, 10000)
+	for i := range values {
+		values[i] = r.Float64()*2000 - 1000
+	}
+	values[0] = 0
+
+	checkSketchAccuracy(t, values, 0.01)
+}
+
+func TestSketchEmpty(t *testing.T) {
+	s := newDDSketch(0.01)
+	if v := s.quantile(0.5); v != 0 {
+		t.Errorf("Expected 0 for empty sketch, got %v", v)
+	}
+
+	s.add(42)
+	s.reset()
+	if v := s.quantile(0.5); v != 0 || s.count != 0 {
+		t.Errorf("Expected 0 after reset, got %v", v)
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	all := newDDSketch(0.01)
+	a := newDDSketch(0.01)
+	b := newDDSketch(0.01)
+
+	for i := 0; i < 10000; i++ {
+		v := r.ExpFloat64() * 100
+		if i%2 == 0 {
+			a.add(v)
+			all.add(v)
+		} else {
+			b.add(-v)
+			all.add(-v)
+		}
+	}
+
+	if err := a.merge(b); err != nil {
+		t.Errorf("merge() got error(%v)", err)
+	}
+
+	if a.count != all.count || a.min != all.min {
+		t.Errorf("Expected count %v min %v, got %v %v", all.count, all.min, a.count, a.min)
+	}
+
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.99, 1} {
+		if a.quantile(q) != all.quantile(q) {
+			t.Errorf("q=%v: expected %v, got %v", q, all.quantile(q), a.quantile(q))
+		}
+	}
+
+	if err := a.merge(newDDSketch(0.02)); err == nil {
+		t.Error("Expected error for merging sketches with different accuracy")
+	}
+}
+
+func TestSketchBoundedMemory(t *testing.T) {
+	s := newDDSketch(0.01)
+	for e := -9.0; e < 300; e += 0.001 {
+		s.add(math.Pow(10, e))
+	}
+
+	if len(s.positive.bins) > sketchMaxBins {
+		t.Errorf("Expected at most %d bins, got %d", sketchMaxBins, len(s.positive.bins))
+	}
+
+	// The high quantiles are still accurate
+	if v := s.quantile(1); math.Abs(v-s.max) > 0.01*s.max {
+		t.Errorf("Expected %v, got %v", s.max, v)
+	}
+}
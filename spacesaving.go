@@ -0,0 +1,103 @@
+package graphite
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// spaceSaving counts the most frequent keys in bounded memory (Space-Saving, Metwally et al., 2005).
+// At most capacity keys are monitored. A new key replaces the least frequent one and inherits its count,
+// so the counts are overestimated by at most the count of the least frequent key, and any key more frequent
+// than 1/capacity of all additions is guaranteed to be monitored.
+type spaceSaving struct {
+	capacity int
+	keys     map[string]*spaceSavingEntry
+	entries  spaceSavingHeap
+}
+
+type spaceSavingEntry struct {
+	key   string
+	count int64
+	index int
+}
+
+// spaceSavingHeap is a min-heap of the entries by count.
+type spaceSavingHeap []*spaceSavingEntry
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, keys: make(map[string]*spaceSavingEntry, capacity)}
+}
+
+func (s *spaceSaving) add(key string) {
+	if e, ok := s.keys[key]; ok {
+		e.count += 1
+		heap.Fix(&s.entries, e.index)
+		return
+	}
+
+	if len(s.entries) < s.capacity {
+		e := &spaceSavingEntry{key: key, count: 1}
+		s.keys[key] = e
+		heap.Push(&s.entries, e)
+		return
+	}
+
+	// Replace the least frequent key
+	e := s.entries[0]
+	delete(s.keys, e.key)
+	e.key = key
+	e.count += 1
+	s.keys[key] = e
+	heap.Fix(&s.entries, 0)
+}
+
+// top returns at most k most frequent keys ordered by count descending, then by key.
+func (s *spaceSaving) top(k int) []spaceSavingEntry {
+	top := make([]spaceSavingEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		top = append(top, *e)
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].count != top[j].count {
+			return top[i].count > top[j].count
+		}
+		return top[i].key < top[j].key
+	})
+	if len(top) > k {
+		top = top[:k]
+	}
+	return top
+}
+
+func (s *spaceSaving) reset() {
+	s.keys = make(map[string]*spaceSavingEntry, s.capacity)
+	s.entries = s.entries[:0]
+}
+
+func (h spaceSavingHeap) Len() int {
+	return len(h)
+}
+
+func (h spaceSavingHeap) Less(i, j int) bool {
+	return h[i].count < h[j].count
+}
+
+func (h spaceSavingHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *spaceSavingHeap) Push(x interface{}) {
+	e := x.(*spaceSavingEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *spaceSavingHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
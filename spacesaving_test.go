@@ -0,0 +1,62 @@
+package graphite
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	s := newSpaceSaving(3)
+	for _, key := range []string{"a", "b", "a", "c", "a", "b"} {
+		s.add(key)
+	}
+
+	expected := []spaceSavingEntry{{key: "a", count: 3}, {key: "b", count: 2}}
+	top := s.top(2)
+	for i := range top {
+		top[i].index = 0
+	}
+	if !reflect.DeepEqual(top, expected) {
+		t.Errorf("Expected %v, got %v", expected, top)
+	}
+
+	// d replaces c, the least frequent key, and inherits its count
+	s.add("d")
+	if len(s.keys) != 3 || s.keys["c"] != nil || s.keys["d"].count != 2 {
+		t.Errorf("Expected d with count 2 instead of c, got %v", s.top(3))
+	}
+
+	s.reset()
+	if len(s.top(2)) != 0 {
+		t.Errorf("Expected no keys, got %v", s.top(2))
+	}
+}
+
+func TestSpaceSavingHeavyHitters(t *testing.T) {
+	// Keys 0-4 make up half of the additions, the rest are spread over 10000 keys
+	r := rand.New(rand.NewSource(1))
+	s := newSpaceSaving(50)
+	exact := make(map[string]int64)
+	for i := 0; i < 100000; i++ {
+		key := strconv.Itoa(r.Intn(5))
+		if i%2 == 1 {
+			key = strconv.Itoa(5 + r.Intn(10000))
+		}
+		s.add(key)
+		exact[key] += 1
+	}
+
+	for _, e := range s.top(5) {
+		n, err := strconv.Atoi(e.key)
+		if err != nil || n >= 5 {
+			t.Errorf("Expected keys 0-4 in top 5, got %v", s.top(5))
+			break
+		}
+		// The overestimation is bounded by the number of additions divided by the capacity
+		if e.count < exact[e.key] || e.count > exact[e.key]+100000/50 {
+			t.Errorf("Expected count of %v in [%v, %v], got %v", e.key, exact[e.key], exact[e.key]+100000/50, e.count)
+		}
+	}
+}
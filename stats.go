@@ -0,0 +1,59 @@
+package graphite
+
+import "math"
+
+// welford keeps the count, mean and the sum of squared deviations of values with Welford's online algorithm,
+// which is numerically stable even for a large number of values with a large mean.
+// Two welford can be merged (Chan et al.), which combines the statistics of a metric into each of its resolutions.
+type welford struct {
+	count int64
+	mean  float64
+	m2    float64
+	min   float64
+	max   float64
+}
+
+func (w *welford) add(value float64) {
+	if w.count == 0 || value < w.min {
+		w.min = value
+	}
+	if w.count == 0 || value > w.max {
+		w.max = value
+	}
+
+	w.count += 1
+	delta := value - w.mean
+	w.mean += delta / float64(w.count)
+	w.m2 += delta * (value - w.mean)
+}
+
+func (w *welford) merge(other welford) {
+	if other.count == 0 {
+		return
+	}
+
+	if w.count == 0 {
+		*w = other
+		return
+	}
+
+	count := w.count + other.count
+	delta := other.mean - w.mean
+	w.mean += delta * float64(other.count) / float64(count)
+	w.m2 += other.m2 + delta*delta*float64(w.count)*float64(other.count)/float64(count)
+	w.min = math.Min(w.min, other.min)
+	w.max = math.Max(w.max, other.max)
+	w.count = count
+}
+
+// variance returns the population variance of the values.
+func (w *welford) variance() float64 {
+	if w.count == 0 {
+		return 0
+	}
+	return w.m2 / float64(w.count)
+}
+
+func (w *welford) stddev() float64 {
+	return math.Sqrt(w.variance())
+}
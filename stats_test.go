@@ -0,0 +1,75 @@
+package graphite
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func exactVariance(values []float64) (float64, float64) {
+	var mean float64
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+
+	var variance float64
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, variance / float64(len(values))
+}
+
+func TestWelford(t *testing.T) {
+	var w welford
+	for _, v := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		w.add(v)
+	}
+
+	if w.count != 8 || w.mean != 5 || w.variance() != 4 || w.stddev() != 2 || w.min != 2 || w.max != 9 {
+		t.Errorf("Expected 8 5 4 2 2 9, got %v %v %v %v %v %v", w.count, w.mean, w.variance(), w.stddev(), w.min, w.max)
+	}
+}
+
+func TestWelfordStability(t *testing.T) {
+	// A large offset breaks the naive sum of squares, but not Welford's algorithm
+	r := rand.New(rand.NewSource(1))
+	values := make([]float64, 1000000)
+	var w welford
+	for i := range values {
+		values[i] = 1e9 + r.Float64()
+		w.add(values[i])
+	}
+
+	mean, variance := exactVariance(values)
+	if math.Abs(w.mean-mean) > 1e-4 || math.Abs(w.variance()-variance) > 1e-6*variance {
+		t.Errorf("Expected %v %v, got %v %v", mean, variance, w.mean, w.variance())
+	}
+}
+
+func TestWelfordMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	var all, a, b welford
+	values := make([]float64, 10000)
+	for i := range values {
+		values[i] = r.NormFloat64()*10 + 100
+		all.add(values[i])
+		if i < 3000 {
+			a.add(values[i])
+		} else {
+			b.add(values[i])
+		}
+	}
+
+	a.merge(b)
+	if a.count != all.count || a.min != all.min || a.max != all.max ||
+		math.Abs(a.mean-all.mean) > 1e-9 || math.Abs(a.variance()-all.variance()) > 1e-9 {
+		t.Errorf("Expected %+v, got %+v", all, a)
+	}
+
+	var empty welford
+	empty.merge(all)
+	if empty != all {
+		t.Errorf("Expected %+v, got %+v", all, empty)
+	}
+}
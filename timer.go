@@ -0,0 +1,28 @@
+package graphite
+
+import "time"
+
+// TimerMetric observes durations of a metric registered with RegisterTimer.
+// Multiple goroutines may invoke methods on a TimerMetric simultaneously.
+type TimerMetric struct {
+	graphite *Graphite
+	name     string
+	unit     time.Duration
+}
+
+// Observe processes the new duration.
+func (t *TimerMetric) Observe(d time.Duration) error {
+	return t.graphite.HandleValue(t.name, float64(d)/float64(t.unit))
+}
+
+// Since processes the duration elapsed since start.
+func (t *TimerMetric) Since(start time.Time) error {
+	return t.Observe(t.graphite.clock.Now().Sub(start))
+}
+
+// Time calls f and processes the duration of the call.
+func (t *TimerMetric) Time(f func()) error {
+	start := t.graphite.clock.Now()
+	f()
+	return t.Since(start)
+}
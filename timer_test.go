@@ -0,0 +1,76 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimer(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock))
+	timer, err := graph.RegisterTimer("timer", time.Millisecond, []float64{10, 100})
+	if err != nil {
+		t.Errorf("RegisterTimer() got error(%v)", err)
+	}
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+
+	timer.Observe(1500 * time.Microsecond)
+	start := clock.Now()
+	clock.Advance(2 * time.Second)
+	timer.Since(start)
+	timer.Time(func() { clock.Advance(500 * time.Millisecond) })
+	clock.Advance(7500 * time.Millisecond)
+
+	expected := []string{
+		"prefix.timer.count 3 946782255",
+		"prefix.timer.hist.0 1 946782255",
+		"prefix.timer.hist.1 0 946782255",
+		"prefix.timer.hist.2 2 946782255",
+		"prefix.timer.max 2000.000000000000 946782255",
+		"prefix.timer.mean 833.833333333333 946782255",
+		"prefix.timer.min 1.500000000000 946782255",
+		"prefix.timer.sum 2501.500000000000 946782255",
+	}
+	assertLines(t, c.waitOutput(), expected)
+	graph.Stop()
+}
+
+func TestRegisterTimer(t *testing.T) {
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false)
+
+	_, err := graph.RegisterTimer("timer", 0, nil)
+	if err == nil {
+		t.Error("Expected error for zero unit")
+	}
+
+	_, err = graph.RegisterTimer("timer", time.Microsecond, []float64{2, 1})
+	if err == nil {
+		t.Error("Expected error for unsorted ranges")
+	}
+
+	timer, err := graph.RegisterTimer("timer", time.Microsecond, nil)
+	if timer == nil || err != nil {
+		t.Errorf("RegisterTimer() got error(%v)", err)
+	}
+
+	if graph.metrics["timer"].mType != metricTimer {
+		t.Error("Expected metricTimer, got ", graph.metrics["timer"].mType)
+	}
+
+	_, err = graph.RegisterTimer("timer", time.Microsecond, nil)
+	if err == nil {
+		t.Error("Expected error(\"RegisterMetric: Metric timer already exist\")")
+	}
+
+	graph, _ = NewGraphite("", 0, "", 0, true)
+	timer, err = graph.RegisterTimer("timer", time.Microsecond, nil)
+	if timer == nil || err != nil {
+		t.Errorf("Got error(%v) for disabled graphite", err)
+	}
+
+	if err = timer.Observe(time.Second); err != nil {
+		t.Errorf("Got error(%v) for disabled graphite", err)
+	}
+}
@@ -0,0 +1,30 @@
+package graphite
+
+// TopKMetric counts keys of a metric registered with RegisterTopK.
+// Multiple goroutines may invoke methods on a TopKMetric simultaneously.
+type TopKMetric struct {
+	graphite *Graphite
+	name     string
+}
+
+// Add counts an occurrence of the key, for example a client ID or an endpoint.
+// The key is sanitized with SanitizeKey, so keys that differ only in the replaced characters are counted together.
+func (t *TopKMetric) Add(key string) error {
+	return t.graphite.sendValue(graphiteValue{name: t.name, member: SanitizeKey(key), op: opKey})
+}
+
+// SanitizeKey makes the key usable as a single node of a metric name: all characters
+// except ASCII letters, digits, '-' and '_' are replaced with '_'. An empty key is replaced with "_".
+func SanitizeKey(key string) string {
+	if key == "" {
+		return "_"
+	}
+
+	b := []byte(key)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
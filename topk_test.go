@@ -0,0 +1,49 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTopKMetric(t *testing.T) {
+	clock := NewFakeClock(time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+	graph, _ := NewGraphite("", 0, "prefix", 10*time.Second, false, WithClock(clock))
+	top, err := graph.RegisterTopK("clients", 2, 10)
+	if err != nil {
+		t.Errorf("RegisterTopK() got error(%v)", err)
+	}
+	c := new(testConnection)
+	graph.conn = c
+	graph.Start()
+
+	for _, key := range []string{"10.0.0.1", "bob", "10.0.0.1", "carol", "bob", "10.0.0.1"} {
+		top.Add(key)
+	}
+	clock.Advance(10 * time.Second)
+
+	expected := "prefix.clients.10_0_0_1 3 946782255\n" +
+		"prefix.clients.bob 2 946782255\n"
+	if output := c.waitOutput(); output != expected {
+		t.Errorf("Expected \"%v\", got \"%v\"", expected, output)
+	}
+	graph.Stop()
+}
+
+func TestSanitizeKey(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"client-42_a", "client-42_a"},
+		{"/api/v1/users", "_api_v1_users"},
+		{"a.b c", "a_b_c"},
+		{"ключ", "________"},
+		{"", "_"},
+	}
+
+	for _, test := range tests {
+		if key := SanitizeKey(test.key); key != test.expected {
+			t.Errorf("Expected %v, got %v", test.expected, key)
+		}
+	}
+}